@@ -1,14 +1,9 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
-	"strconv"
-	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/lcpu-dev/vmsched/models"
@@ -75,6 +70,14 @@ func main() {
 			if err != nil {
 				return err
 			}
+			err = models.OpenLedger(orm)
+			if err != nil {
+				return err
+			}
+			err = models.SeedRoles(orm)
+			if err != nil {
+				return err
+			}
 			if ok, _ := orm.Exist(&models.User{Role: "admin"}); !ok {
 				u := &models.User{
 					Name:    "admin",
@@ -90,21 +93,65 @@ func main() {
 				fmt.Println("DB already initialized")
 			}
 			tok := &models.Token{User: "admin"}
-			if ok, _ := orm.Get(tok); !ok {
-				tok.Name = "admin_token"
-				s := sha256.New()
-				s.Write([]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))})
-				s.Write([]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))})
-				s.Write([]byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
-				s.Write([]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))})
-				s.Write([]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))})
-				tok.Secret = hex.EncodeToString(s.Sum(nil))
-				_, err = orm.Insert(tok)
+			if ok, _ := orm.Get(tok); ok {
+				fmt.Printf("Admin user '%v'\n  token name '%v'\n", tok.User, tok.Name)
+				return nil
+			}
+			tok.Name = "admin_token"
+			secret, err := models.NewSecret()
+			if err != nil {
+				return err
+			}
+			tok.Secret, err = models.HashSecret(secret)
+			if err != nil {
+				return err
+			}
+			_, err = orm.Insert(tok)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Admin user '%v'\n  token name '%v'\n  secret '%v'\n", tok.User, tok.Name, secret)
+			return nil
+		},
+	})
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:      "migrate-tokens",
+		UsageText: "Hash token secrets stored in plain text",
+		Action: func(ctx *cli.Context) error {
+			orm, err := xorm.NewEngine(conf.Database.Driver, conf.Database.DSN)
+			if err != nil {
+				return err
+			}
+			tokens := []*models.Token{}
+			err = orm.Find(&tokens)
+			if err != nil {
+				return err
+			}
+			migrated, deleted := 0, 0
+			for _, tok := range tokens {
+				if models.SecretHashed(tok.Secret) {
+					continue
+				}
+				if len(tok.Secret) < models.MinSecretLength {
+					_, err = orm.Delete(&models.Token{Name: tok.Name, Secret: tok.Secret})
+					if err != nil {
+						return err
+					}
+					fmt.Printf("deleted token '%v' of user '%v', its secret is shorter than %v characters\n", tok.Name, tok.User, models.MinSecretLength)
+					deleted++
+					continue
+				}
+				hash, err := models.HashSecret(tok.Secret)
+				if err != nil {
+					return err
+				}
+				_, err = orm.Cols("secret").Update(&models.Token{Secret: hash}, &models.Token{Name: tok.Name, Secret: tok.Secret})
 				if err != nil {
 					return err
 				}
+				migrated++
 			}
-			fmt.Printf("Admin user '%v'\n  token name '%v'\n  secret '%v'\n", tok.User, tok.Name, tok.Secret)
+			fmt.Printf("%v of %v tokens migrated, %v deleted\n", migrated, len(tokens), deleted)
 			return nil
 		},
 	})
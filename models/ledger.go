@@ -0,0 +1,48 @@
+package models
+
+import "xorm.io/xorm"
+
+const (
+	LedgerDebit      = "debit"
+	LedgerCredit     = "credit"
+	LedgerRefund     = "refund"
+	LedgerAdjustment = "adjustment"
+)
+
+// OpenLedger records an adjustment for every balance that isn't explained by
+// the ledger yet, e.g. balances set before the ledger existed.
+func OpenLedger(orm *xorm.Engine) error {
+	users := []*User{}
+	err := orm.Find(&users)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		entries := []*LedgerEntry{}
+		err = orm.Find(&entries, &LedgerEntry{User: u.Name})
+		if err != nil {
+			return err
+		}
+		sums := map[string]int{}
+		for _, e := range entries {
+			sums[e.Currency] += e.Amount
+		}
+		for k, v := range u.Balance {
+			if v == sums[k] {
+				continue
+			}
+			_, err = orm.Insert(&LedgerEntry{
+				User:     u.Name,
+				Currency: k,
+				Amount:   v - sums[k],
+				Kind:     LedgerAdjustment,
+				Actor:    "system",
+				Reason:   "opening balance",
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
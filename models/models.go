@@ -7,36 +7,99 @@ import (
 )
 
 type Task struct {
-	Name         string    `xorm:"name pk notnull"`
-	InstanceType string    `xorm:"instance_type notnull"`
-	Creation     time.Time `xorm:"creation created"`
-	QueueTime    time.Time `xorm:"queue_time"`
-	EndTime      time.Time `xorm:"end_time"`
-	Status       string    `xorm:"status"` // active, queued, terminating, inactive, creating, deleting
-	TargetID     int64     `xorm:"target_id"`
-	Instance     string    `xorm:"instance"`
-	User         string    `xorm:"user notnull"`
-	Version      int       `xorm:"version"`
+	Name         string         `xorm:"name pk notnull"`
+	InstanceType string         `xorm:"instance_type notnull"`
+	Creation     time.Time      `xorm:"creation created"`
+	Updated      time.Time      `xorm:"updated updated"`
+	QueueTime    time.Time      `xorm:"queue_time"`
+	EndTime      time.Time      `xorm:"end_time"`
+	ActiveTime   time.Time      `xorm:"active_time"` // start of the current activation, stale if before QueueTime
+	LifeTime     time.Duration  `xorm:"life_time"`   // paid lifetime of the current activation
+	Price        map[string]int `xorm:"price json"`  // price per minute paid for the current activation
+	Status       string         `xorm:"status"`      // see TaskStates
+	TargetID     int64          `xorm:"target_id"`
+	Instance     string         `xorm:"instance"`
+	User         string         `xorm:"user notnull"`
+	Count        int            `xorm:"count"`           // instances in the group, 0 is read as 1
+	Preemptible  bool           `xorm:"preemptible"`     // the current activation may be evicted
+	Instances    []string       `xorm:"instances json"`  // every instance, Instance is the first
+	TargetIDs    []int64        `xorm:"target_ids json"` // targets of the current activation, TargetID is the first
+	Completed    time.Time      `xorm:"completed"`       // when an activation last ran to its end or was stopped by its user
+	After        []string       `xorm:"after json"`      // tasks the last held activation waits for
+	HeldLifeTime time.Duration  `xorm:"held_life_time"`  // lifetime to queue a held task for
+	HeldTarget   int64          `xorm:"held_target"`     // target a held task asked for, any when 0
+	Version      int            `xorm:"'version' version"`
+}
+
+// Size returns how many instances the task runs at once.
+func (t *Task) Size() int {
+	if t.Count < 1 {
+		return 1
+	}
+	return t.Count
+}
+
+// AllInstances returns every instance of the task, tasks from before groups
+// only have Instance.
+func (t *Task) AllInstances() []string {
+	if len(t.Instances) == 0 {
+		return []string{t.Instance}
+	}
+	return t.Instances
+}
+
+// AllTargets returns the targets of the current or last activation.
+func (t *Task) AllTargets() []int64 {
+	if len(t.TargetIDs) == 0 {
+		if t.TargetID == 0 {
+			return nil
+		}
+		return []int64{t.TargetID}
+	}
+	return t.TargetIDs
 }
 
 type User struct {
 	Name    string         `xorm:"name pk notnull"`
-	Role    string         `xorm:"role"` // admin, user, banned
+	Role    string         `xorm:"role"`          // name of a Role
+	Source  string         `xorm:"source"`        // ldap or oidc for users created on login
+	Subject string         `xorm:"subject index"` // issuer and subject of the OIDC account of an oidc user
 	Balance map[string]int `xorm:"balance json"`
-	Version int            `xorm:"version"`
+	Version int            `xorm:"'version' version"`
+}
+
+// Role is a named set of permissions, see Permissions. User.Role names one.
+type Role struct {
+	Name        string    `xorm:"name pk"`
+	Permissions []string  `xorm:"permissions json"`
+	Description string    `xorm:"description"`
+	Creation    time.Time `xorm:"creation created"`
+	Version     int       `xorm:"'version' version"`
 }
 
 type Token struct {
-	Name   string `xorm:"name pk"`
-	Secret string `xorm:"secret varchar(512)"`
-	User   string `xorm:"user"`
+	Name     string    `xorm:"name pk"`
+	Secret   string    `xorm:"secret varchar(512)"` // see HashSecret
+	User     string    `xorm:"user"`
+	Scopes   []string  `xorm:"scopes json"` // what the token may do, anything when empty
+	Expires  time.Time `xorm:"expires"`     // never when zero
+	LastUsed time.Time `xorm:"last_used"`
+	LastIP   string    `xorm:"last_ip"`
+	Session  bool      `xorm:"session"` // given out by a login, removed once expired
+	Creation time.Time `xorm:"creation created"`
 }
 
 type InstanceType struct {
 	Name        string         `xorm:"name pk notnull"`
 	Description string         `xorm:"description text"`
 	Configure   string         `xorm:"configure text"`
-	Price       map[string]int `xorm:"price json"` // price per minute
+	Price       map[string]int `xorm:"price json"`      // price per minute
+	SpotPrice   map[string]int `xorm:"spot_price json"` // price per minute of preemptible tasks, none when empty
+	// tasks whose instances all stay below both idle rates this long are
+	// stopped, 0 never stops them
+	IdleAfter   time.Duration `xorm:"idle_after"`
+	IdleCPU     float64       `xorm:"idle_cpu"`     // CPU time per second, 1 is one busy core
+	IdleNetwork int64         `xorm:"idle_network"` // bytes per second sent and received
 }
 
 type InstanceTarget struct {
@@ -46,7 +109,7 @@ type InstanceTarget struct {
 	Status   string           `xorm:"status"` // busy or idle
 	Instance string           `xorm:"instance"`
 	Task     string           `xorm:"task"`
-	Version  int              `xorm:"version"`
+	Version  int              `xorm:"'version' version"`
 }
 
 type Queue struct {
@@ -56,4 +119,86 @@ type Queue struct {
 	InstanceType string        `xorm:"instance_type notnull"`
 	LifeTime     time.Duration `xorm:"life_time"`
 	Creation     time.Time     `xorm:"creation created"`
+	TargetID     int64         `xorm:"target_id"` // target the task asked for, any when 0
+	Count        int           `xorm:"count"`     // targets the task needs at once
+	Preemptible  bool          `xorm:"preemptible"`
+}
+
+type Lease struct {
+	Name    string    `xorm:"name pk notnull"`
+	Holder  string    `xorm:"holder"`
+	Token   int64     `xorm:"token"` // fencing token, increased whenever the holder changes
+	Expire  time.Time `xorm:"expire"`
+	Renewed time.Time `xorm:"renewed"`
+}
+
+type TaskEvent struct {
+	Id       int64     `xorm:"'id' pk autoincr"`
+	Task     string    `xorm:"task index notnull"`
+	User     string    `xorm:"user index"` // owner of the task, empty in older events
+	Actor    string    `xorm:"actor"`      // user name, or "system"
+	From     string    `xorm:"from_status"`
+	To       string    `xorm:"to_status"`
+	Reason   string    `xorm:"reason text"`
+	Creation time.Time `xorm:"creation created"`
+}
+
+type LedgerEntry struct {
+	Id       int64     `xorm:"'id' pk autoincr"`
+	User     string    `xorm:"user index notnull"`
+	Currency string    `xorm:"currency notnull"`
+	Amount   int       `xorm:"amount"` // negative for debits
+	Kind     string    `xorm:"kind"`   // see Ledger* constants
+	Task     string    `xorm:"task"`
+	Actor    string    `xorm:"actor"`
+	Reason   string    `xorm:"reason text"`
+	Creation time.Time `xorm:"creation created index"`
+}
+
+// Usage is one finished activation, kept for fair-share scheduling.
+type Usage struct {
+	Id           int64     `xorm:"'id' pk autoincr"`
+	User         string    `xorm:"user index notnull"`
+	Task         string    `xorm:"task"`
+	InstanceType string    `xorm:"instance_type"`
+	Count        int       `xorm:"count"`
+	Start        time.Time `xorm:"start_time"`
+	End          time.Time `xorm:"end_time index"`
+}
+
+// Reservation keeps some targets of a type for its users between Start and
+// End. Targets it gives up when released shrink, Count stays as requested.
+type Reservation struct {
+	Id           int64     `xorm:"'id' pk autoincr"`
+	InstanceType string    `xorm:"instance_type notnull"`
+	Count        int       `xorm:"count"`
+	Start        time.Time `xorm:"start_time"`
+	End          time.Time `xorm:"end_time index"`
+	Users        []string  `xorm:"users json"`
+	Targets      []int64   `xorm:"targets json"`
+	Released     bool      `xorm:"released"`
+	Description  string    `xorm:"description text"`
+	Creator      string    `xorm:"creator"`
+	Creation     time.Time `xorm:"creation created"`
+	Version      int       `xorm:"'version' version"`
+}
+
+const (
+	ScheduleSkip    = "skip"     // runs missed while nothing was running are dropped
+	ScheduleCatchUp = "catch-up" // missed runs make up for it with one activation
+)
+
+// Schedule activates a task of its user whenever a cron expression fires.
+type Schedule struct {
+	Id         int64         `xorm:"'id' pk autoincr"`
+	User       string        `xorm:"user index notnull"`
+	Task       string        `xorm:"task notnull"`
+	Cron       string        `xorm:"cron"` // five fields or a descriptor like @daily
+	LifeTime   time.Duration `xorm:"life_time"`
+	Missed     string        `xorm:"missed"` // ScheduleSkip or ScheduleCatchUp
+	NextRun    time.Time     `xorm:"next_run index"`
+	LastRun    time.Time     `xorm:"last_run"`
+	LastResult string        `xorm:"last_result text"`
+	Creation   time.Time     `xorm:"creation created"`
+	Version    int           `xorm:"'version' version"`
 }
@@ -0,0 +1,82 @@
+package models
+
+import "xorm.io/xorm"
+
+// Permissions a role can grant. Without any a user may only look at its own
+// account and the instance types, as banned users do.
+const (
+	PermUse                 = "use"                   // own tasks, schedules, consoles and tokens
+	PermViewTasks           = "view-tasks"            // tasks, schedules and instances of everyone
+	PermManageTasks         = "manage-tasks"          // create, change and delete tasks of everyone
+	PermConsoles            = "consoles"              // consoles and files of everyone's instances
+	PermManageUsers         = "manage-users"          // create users, set their role, their tokens
+	PermTopUp               = "top-up"                // post to and read the ledger of everyone
+	PermManageInstanceTypes = "manage-instance-types" // create, change and delete instance types
+	PermManageReservations  = "manage-reservations"
+	PermViewLease           = "view-lease"
+	PermManageRoles         = "manage-roles"
+	PermAll                 = "*" // every permission, those added later too
+)
+
+// Permissions lists every permission.
+var Permissions = []string{
+	PermUse, PermViewTasks, PermManageTasks, PermConsoles, PermManageUsers, PermTopUp,
+	PermManageInstanceTypes, PermManageReservations, PermViewLease, PermManageRoles, PermAll,
+}
+
+// BuiltinRoles are created by init-db and can't be deleted. Until then they
+// apply as defined here.
+var BuiltinRoles = []*Role{
+	{Name: "admin", Permissions: []string{PermAll}, Description: "may do anything"},
+	{Name: "user", Permissions: []string{PermUse}, Description: "runs tasks of its own"},
+	{Name: "banned", Permissions: []string{}, Description: "may not run anything"},
+}
+
+// BuiltinRole returns the builtin role with a name, or nil.
+func BuiltinRole(name string) *Role {
+	for _, r := range BuiltinRoles {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Has reports whether the role grants a permission.
+func (r *Role) Has(perm string) bool {
+	for _, p := range r.Permissions {
+		if p == perm || p == PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether the role grants everything another one does.
+func (r *Role) Covers(other *Role) bool {
+	for _, p := range other.Permissions {
+		if !r.Has(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeedRoles creates the builtin roles that are missing, leaving the others as
+// they were changed.
+func SeedRoles(orm *xorm.Engine) error {
+	for _, r := range BuiltinRoles {
+		ok, err := orm.Exist(&Role{Name: r.Name})
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		_, err = orm.Insert(&Role{Name: r.Name, Permissions: r.Permissions, Description: r.Description})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package models
+
+const (
+	TaskCreating    = "creating"
+	TaskInactive    = "inactive"
+	TaskHeld        = "held" // waiting for the tasks it runs after
+	TaskQueued      = "queued"
+	TaskActive      = "active"
+	TaskTerminating = "terminating"
+	TaskDeleting    = "deleting"
+	// TaskDeleted is never stored in Task.Status, it only shows up in events
+	// once the row is gone
+	TaskDeleted = "deleted"
+)
+
+// TaskStateMachine maps a task status to the statuses it may change to.
+type TaskStateMachine map[string][]string
+
+func (m TaskStateMachine) CanTransit(from string, to string) bool {
+	for _, s := range m[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+var TaskStates = TaskStateMachine{
+	"":              {TaskCreating},
+	TaskCreating:    {TaskInactive, TaskDeleted},
+	TaskInactive:    {TaskHeld, TaskQueued, TaskDeleting},
+	TaskHeld:        {TaskQueued, TaskInactive},
+	TaskQueued:      {TaskActive, TaskInactive},
+	TaskActive:      {TaskTerminating},
+	TaskTerminating: {TaskInactive},
+	TaskDeleting:    {TaskDeleted},
+}
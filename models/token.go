@@ -0,0 +1,123 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Scopes a token can be limited to.
+const (
+	ScopeTaskRead  = "task:read"  // read tasks, instances, account and billing
+	ScopeTaskWrite = "task:write" // create, change and delete tasks and schedules
+	ScopeConsole   = "console"    // console, exec and spice websockets
+	ScopeWebDAV    = "webdav"     // files of instances over WebDAV
+	ScopeToken     = "token"      // create, list and delete tokens
+	ScopeAdmin     = "admin"      // use the rights of an admin user
+)
+
+// Scopes lists every scope.
+var Scopes = []string{ScopeTaskRead, ScopeTaskWrite, ScopeConsole, ScopeWebDAV, ScopeToken, ScopeAdmin}
+
+// Allows reports whether the token may be used for scope, tokens without
+// scopes may do anything.
+func (t *Token) Allows(scope string) bool {
+	if scope == "" || len(t.Scopes) == 0 {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token may not be used any more at now.
+func (t *Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// argon2id parameters of new hashes, verifying reads them from the hash so
+// they can change without invalidating stored secrets.
+const (
+	hashTime    = 2
+	hashMemory  = 19 * 1024 // KiB
+	hashThreads = 1
+	hashSaltLen = 16
+	hashKeyLen  = 32
+)
+
+const hashPrefix = "$argon2id$"
+
+// MinSecretLength is the shortest plain text secret migrate-tokens keeps,
+// shorter ones are too easy to guess.
+const MinSecretLength = 16
+
+// NewSecret returns a random token secret, 256 bits in hex.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashSecret returns the salted argon2id hash of a secret, in the usual
+// $argon2id$v=19$m=...,t=...,p=...$salt$key form.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(secret), salt, hashTime, hashMemory, hashThreads, hashKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", hashPrefix, argon2.Version, hashMemory, hashTime, hashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// SecretHashed reports whether a stored secret is a hash, tokens from before
+// hashing keep the secret itself until migrated.
+func SecretHashed(stored string) bool {
+	return strings.HasPrefix(stored, hashPrefix)
+}
+
+// VerifySecret compares a secret with a stored hash in constant time. Secrets
+// that are not hashed never match.
+func VerifySecret(stored string, secret string) bool {
+	if !SecretHashed(stored) {
+		return false
+	}
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil || iterations < 1 || threads < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(secret), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
@@ -7,8 +7,15 @@ func Sync(orm *xorm.Engine) error {
 		InstanceType{},
 		InstanceTarget{},
 		User{},
+		Role{},
 		Token{},
 		Task{},
 		Queue{},
+		Lease{},
+		TaskEvent{},
+		LedgerEntry{},
+		Usage{},
+		Reservation{},
+		Schedule{},
 	)
 }
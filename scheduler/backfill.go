@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"sort"
+	"time"
+)
+
+// Backfill is EASY backfilling on top of submission order. Entries start in
+// order until one can't; that head gets a reservation on as many targets as it
+// needs among those it fits that free up first. Later entries may then start
+// on the remaining free targets, on reserved ones only if their lifetime ends
+// before the head's projected start, so they never delay the head.
+type Backfill struct{}
+
+func (*Backfill) Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment {
+	rslt := greedy(entries, targets, now, firstTarget)
+	if len(rslt) == len(entries) {
+		return rslt
+	}
+	// when every target will be free again, given what just started
+	freeAt := map[*Target]time.Time{}
+	for _, t := range targets {
+		freeAt[t] = t.FreeAt
+	}
+	for _, a := range rslt {
+		for _, t := range a.Targets {
+			freeAt[t] = now.Add(a.Entry.LifeTime)
+		}
+	}
+	// the head is the first entry greedy didn't start, it may have skipped some
+	// before stopping
+	assigned := map[*Entry]bool{}
+	for _, a := range rslt {
+		assigned[a.Entry] = true
+	}
+	var head *Entry
+	rest := []*Entry{}
+	for _, e := range entries {
+		switch {
+		case assigned[e]:
+		case head == nil:
+			head = e
+		default:
+			rest = append(rest, e)
+		}
+	}
+	candidates := []*Target{}
+	for _, t := range targets {
+		if head.Fits(t, freeAt[t]) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) < head.Size() {
+		// the head can never start, don't let it block the queue
+		free := []*Target{}
+		for _, t := range targets {
+			if !freeAt[t].After(now) {
+				free = append(free, t)
+			}
+		}
+		return append(rslt, greedy(rest, free, now, firstTarget)...)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return freeAt[candidates[i]].Before(freeAt[candidates[j]])
+	})
+	shadow := freeAt[candidates[head.Size()-1]]
+	reserved := map[*Target]bool{}
+	for _, t := range candidates[:head.Size()] {
+		reserved[t] = true
+	}
+	free := []*Target{}
+	for _, t := range targets {
+		if !freeAt[t].After(now) {
+			free = append(free, t)
+		}
+	}
+	for _, e := range rest {
+		short := !now.Add(e.LifeTime).After(shadow)
+		// unreserved targets first, so the reservation stays whole if possible
+		picked := []*Target{}
+		for _, t := range free {
+			if len(picked) < e.Size() && !reserved[t] && e.Fits(t, now) {
+				picked = append(picked, t)
+			}
+		}
+		if short {
+			for _, t := range free {
+				if len(picked) < e.Size() && reserved[t] && e.Fits(t, now) {
+					picked = append(picked, t)
+				}
+			}
+		}
+		if len(picked) < e.Size() {
+			continue
+		}
+		rslt = append(rslt, &Assignment{Entry: e, Targets: picked})
+		for _, t := range picked {
+			free = remove(free, t)
+		}
+	}
+	return rslt
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"sort"
+	"time"
+)
+
+// greedy walks entries in order and gives each one the free targets chosen
+// one by one by pick among those it fits. It stops at the first entry there
+// aren't enough free targets for, so later entries never overtake it. An entry
+// kept off the free targets by its pins or by reservations is skipped instead,
+// it would hold the targets up for those they are reserved for.
+func greedy(entries []*Entry, targets []*Target, now time.Time, pick func(free []*Target) int) []*Assignment {
+	free := []*Target{}
+	for _, t := range targets {
+		if t.Free(now) {
+			free = append(free, t)
+		}
+	}
+	rslt := []*Assignment{}
+	for _, e := range entries {
+		fits := []*Target{}
+		for _, t := range free {
+			if e.Fits(t, now) {
+				fits = append(fits, t)
+			}
+		}
+		if len(free) < e.Size() {
+			break
+		}
+		if len(fits) < e.Size() {
+			continue
+		}
+		a := &Assignment{Entry: e}
+		for len(a.Targets) < e.Size() {
+			t := fits[pick(fits)]
+			a.Targets = append(a.Targets, t)
+			fits = remove(fits, t)
+			free = remove(free, t)
+		}
+		rslt = append(rslt, a)
+	}
+	return rslt
+}
+
+func remove(targets []*Target, t *Target) []*Target {
+	rslt := make([]*Target, 0, len(targets))
+	for _, o := range targets {
+		if o != t {
+			rslt = append(rslt, o)
+		}
+	}
+	return rslt
+}
+
+func firstTarget(free []*Target) int {
+	return 0
+}
+
+// FIFO serves entries in submission order on the first free target.
+type FIFO struct{}
+
+func (*FIFO) Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment {
+	return greedy(entries, targets, now, firstTarget)
+}
+
+// Priority serves higher priorities first, then in submission order.
+type Priority struct{}
+
+func (*Priority) Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment {
+	ordered := append([]*Entry{}, entries...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority > ordered[j].Priority
+	})
+	return greedy(ordered, targets, now, firstTarget)
+}
+
+// FairShare serves higher priorities first and, among equal priorities, the
+// users who consumed the least recently.
+type FairShare struct{}
+
+func (*FairShare) UsesUsage() bool {
+	return true
+}
+
+func (*FairShare) Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment {
+	ordered := append([]*Entry{}, entries...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Usage < b.Usage
+	})
+	return greedy(ordered, targets, now, firstTarget)
+}
+
+// BinPacking serves entries in submission order, each on a free target of the
+// node with the most busy targets, so that whole nodes stay free for as long
+// as possible.
+type BinPacking struct{}
+
+func (*BinPacking) Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment {
+	busy := map[string]int{}
+	for _, t := range targets {
+		if !t.Free(now) {
+			busy[t.Node]++
+		}
+	}
+	return greedy(entries, targets, now, func(free []*Target) int {
+		best := 0
+		for i, t := range free {
+			if busy[t.Node] > busy[free[best].Node] {
+				best = i
+			}
+		}
+		busy[free[best].Node]++
+		return best
+	})
+}
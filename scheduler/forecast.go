@@ -0,0 +1,61 @@
+package scheduler
+
+import "time"
+
+// Forecast simulates a scheduler: it schedules at now, moves the clock to the
+// next time a target frees up or a reservation starts or ends, and repeats,
+// assuming every entry keeps its target for its whole lifetime. It returns the
+// projected start of every entry that would ever run, or nil when there are no
+// targets at all.
+func Forecast(s Scheduler, entries []*Entry, targets []*Target, now time.Time) map[*Entry]time.Time {
+	if len(targets) == 0 {
+		return nil
+	}
+	sim := make([]*Target, len(targets))
+	for i, t := range targets {
+		c := *t
+		sim[i] = &c
+	}
+	pending := append([]*Entry{}, entries...)
+	starts := map[*Entry]time.Time{}
+	for len(pending) > 0 {
+		assigned := s.Schedule(pending, sim, now)
+		if len(assigned) == 0 {
+			next := time.Time{}
+			later := func(tm time.Time) {
+				if tm.After(now) && (next.IsZero() || tm.Before(next)) {
+					next = tm
+				}
+			}
+			for _, t := range sim {
+				later(t.FreeAt)
+				for _, r := range t.Reservations {
+					later(r.Start)
+					later(r.End)
+				}
+			}
+			if next.IsZero() {
+				// the scheduler won't start the rest on these targets
+				break
+			}
+			now = next
+			continue
+		}
+		started := map[*Entry]bool{}
+		for _, a := range assigned {
+			starts[a.Entry] = now
+			started[a.Entry] = true
+			for _, t := range a.Targets {
+				t.FreeAt = now.Add(a.Entry.LifeTime)
+			}
+		}
+		left := pending[:0]
+		for _, e := range pending {
+			if !started[e] {
+				left = append(left, e)
+			}
+		}
+		pending = left
+	}
+	return starts
+}
@@ -0,0 +1,164 @@
+// Package scheduler decides which queued entries start on which targets.
+//
+// A Scheduler is a pure function of its input: the server collects the queue
+// and the targets of an instance type, asks the configured Scheduler for
+// assignments and carries them out. Policies are looked up by name in a
+// registry, so a build can add its own with Register before the server starts.
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is a queued task waiting for a target.
+type Entry struct {
+	ID       int64
+	Task     string
+	User     string
+	Creation time.Time
+	LifeTime time.Duration
+	Priority int     // static priority, higher goes first
+	Usage    float64 // decayed minutes the user consumed recently
+	Targets  []int64 // targets the entry may run on, any when empty
+	Count    int     // distinct targets it needs at once, 0 is read as 1
+	// preemptible entries come after all others, the server may stop running
+	// preemptible tasks to start the others
+	Preemptible bool
+}
+
+// Size returns how many targets the entry needs.
+func (e *Entry) Size() int {
+	if e.Count < 1 {
+		return 1
+	}
+	return e.Count
+}
+
+// Fits reports whether the entry may start on a target at now: the target is
+// one it asked for, and every reservation of the target its lifetime overlaps
+// lets its user in.
+func (e *Entry) Fits(t *Target, now time.Time) bool {
+	if len(e.Targets) > 0 {
+		found := false
+		for _, id := range e.Targets {
+			if id == t.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	end := now.Add(e.LifeTime)
+	for _, r := range t.Reservations {
+		if r.Start.Before(end) && r.End.After(now) && !r.Admits(e.User) {
+			return false
+		}
+	}
+	return true
+}
+
+// Target is a slot an entry can run on.
+type Target struct {
+	ID           int64
+	Node         string    // cluster member the target lives on
+	FreeAt       time.Time // when the running task ends, not after now for free targets
+	Reservations []*Reservation
+}
+
+// Reservation keeps a target for some users during a time window.
+type Reservation struct {
+	Start time.Time
+	End   time.Time
+	Users []string
+}
+
+// Admits reports whether a user may use the reserved target.
+func (r *Reservation) Admits(user string) bool {
+	for _, u := range r.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Free reports whether the target can take an entry at now.
+func (t *Target) Free(now time.Time) bool {
+	return !t.FreeAt.After(now)
+}
+
+// Assignment starts an entry on as many targets as it needs.
+type Assignment struct {
+	Entry   *Entry
+	Targets []*Target
+}
+
+// Scheduler assigns entries to targets. Entries come in submission order and
+// targets in id order, busy ones included so that a policy can plan ahead.
+// Only free targets may be assigned, each at most once, and an entry gets all
+// the targets it needs or none; entries left out stay in the queue.
+// Implementations must not keep or modify their input.
+type Scheduler interface {
+	Schedule(entries []*Entry, targets []*Target, now time.Time) []*Assignment
+}
+
+// UsageAware is implemented by schedulers that read Entry.Usage. Usage is
+// costly to compute, so it is left 0 for the others.
+type UsageAware interface {
+	UsesUsage() bool
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Scheduler{}
+)
+
+// Register makes a scheduler available by name. It panics when the name is
+// taken, like database/sql.Register.
+func Register(name string, s Scheduler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if s == nil {
+		panic("scheduler: Register scheduler is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("scheduler: Register called twice for scheduler " + name)
+	}
+	registry[name] = s
+}
+
+// Get returns the scheduler registered under name.
+func Get(name string) (Scheduler, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	s, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduler %#v", name)
+	}
+	return s, nil
+}
+
+// Names returns the registered scheduler names, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("fifo", &FIFO{})
+	Register("priority", &Priority{})
+	Register("fair-share", &FairShare{})
+	Register("bin-packing", &BinPacking{})
+	Register("backfill", &Backfill{})
+}
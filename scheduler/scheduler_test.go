@@ -0,0 +1,269 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+
+func entry(task string, lifetime time.Duration) *Entry {
+	return &Entry{Task: task, User: task, Creation: now, LifeTime: lifetime}
+}
+
+func free(ids ...int64) []*Target {
+	targets := []*Target{}
+	for _, id := range ids {
+		targets = append(targets, &Target{ID: id, FreeAt: now})
+	}
+	return targets
+}
+
+// started maps the tasks of assignments to the targets they got, in order.
+func started(assigned []*Assignment) map[string][]int64 {
+	rslt := map[string][]int64{}
+	for _, a := range assigned {
+		for _, t := range a.Targets {
+			rslt[a.Entry.Task] = append(rslt[a.Entry.Task], t.ID)
+		}
+	}
+	return rslt
+}
+
+func TestSchedule(t *testing.T) {
+	busy := func(id int64, node string, until time.Duration) *Target {
+		return &Target{ID: id, Node: node, FreeAt: now.Add(until)}
+	}
+	onNode := func(id int64, node string) *Target {
+		return &Target{ID: id, Node: node, FreeAt: now}
+	}
+	withPriority := func(e *Entry, p int) *Entry {
+		e.Priority = p
+		return e
+	}
+	withUsage := func(e *Entry, u float64) *Entry {
+		e.Usage = u
+		return e
+	}
+	withCount := func(e *Entry, n int) *Entry {
+		e.Count = n
+		return e
+	}
+	pinned := func(e *Entry, ids ...int64) *Entry {
+		e.Targets = ids
+		return e
+	}
+	cases := []struct {
+		name    string
+		policy  Scheduler
+		entries []*Entry
+		targets []*Target
+		want    map[string][]int64
+	}{
+		{
+			name:    "fifo in submission order",
+			policy:  &FIFO{},
+			entries: []*Entry{entry("a", time.Hour), entry("b", time.Hour), entry("c", time.Hour)},
+			targets: free(1, 2),
+			want:    map[string][]int64{"a": {1}, "b": {2}},
+		},
+		{
+			name:    "fifo leaves busy targets alone",
+			policy:  &FIFO{},
+			entries: []*Entry{entry("a", time.Hour), entry("b", time.Hour)},
+			targets: []*Target{busy(1, "", time.Hour), onNode(2, "")},
+			want:    map[string][]int64{"a": {2}},
+		},
+		{
+			name:    "fifo doesn't let entries overtake a gang that doesn't fit",
+			policy:  &FIFO{},
+			entries: []*Entry{withCount(entry("a", time.Hour), 3), entry("b", time.Hour)},
+			targets: free(1, 2),
+			want:    map[string][]int64{},
+		},
+		{
+			name:    "gangs get distinct targets",
+			policy:  &FIFO{},
+			entries: []*Entry{withCount(entry("a", time.Hour), 2), entry("b", time.Hour)},
+			targets: free(1, 2, 3),
+			want:    map[string][]int64{"a": {1, 2}, "b": {3}},
+		},
+		{
+			name:    "pinned entries get their target",
+			policy:  &FIFO{},
+			entries: []*Entry{pinned(entry("a", time.Hour), 2), entry("b", time.Hour)},
+			targets: free(1, 2),
+			want:    map[string][]int64{"a": {2}, "b": {1}},
+		},
+		{
+			name:    "pinned entries waiting for their target don't block the queue",
+			policy:  &FIFO{},
+			entries: []*Entry{pinned(entry("a", time.Hour), 1), entry("b", time.Hour)},
+			targets: []*Target{busy(1, "", time.Hour), onNode(2, "")},
+			want:    map[string][]int64{"b": {2}},
+		},
+		{
+			name:   "reserved targets go to members behind others",
+			policy: &FIFO{},
+			entries: []*Entry{
+				entry("other", time.Hour),
+				entry("member", time.Hour),
+			},
+			targets: []*Target{{ID: 1, FreeAt: now, Reservations: []*Reservation{
+				{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Users: []string{"member"}},
+			}}},
+			want: map[string][]int64{"member": {1}},
+		},
+		{
+			name:   "priority first, then submission order",
+			policy: &Priority{},
+			entries: []*Entry{
+				entry("a", time.Hour),
+				withPriority(entry("b", time.Hour), 5),
+				withPriority(entry("c", time.Hour), 5),
+			},
+			targets: free(1, 2),
+			want:    map[string][]int64{"b": {1}, "c": {2}},
+		},
+		{
+			name:   "fair-share serves the lightest users first",
+			policy: &FairShare{},
+			entries: []*Entry{
+				withUsage(entry("a", time.Hour), 300),
+				withUsage(entry("b", time.Hour), 10),
+				withUsage(entry("c", time.Hour), 100),
+			},
+			targets: free(1, 2),
+			want:    map[string][]int64{"b": {1}, "c": {2}},
+		},
+		{
+			name:   "fair-share still puts priority before usage",
+			policy: &FairShare{},
+			entries: []*Entry{
+				withUsage(entry("a", time.Hour), 10),
+				withPriority(withUsage(entry("b", time.Hour), 300), 1),
+			},
+			targets: free(1),
+			want:    map[string][]int64{"b": {1}},
+		},
+		{
+			name:    "bin-packing fills the busiest node",
+			policy:  &BinPacking{},
+			entries: []*Entry{entry("a", time.Hour), entry("b", time.Hour)},
+			targets: []*Target{onNode(1, "n1"), onNode(2, "n2"), busy(3, "n2", time.Hour), onNode(4, "n2")},
+			want:    map[string][]int64{"a": {2}, "b": {4}},
+		},
+		{
+			name:   "backfill starts short entries on targets kept for the head",
+			policy: &Backfill{},
+			entries: []*Entry{
+				withCount(entry("head", time.Hour), 2),
+				entry("short", 30*time.Minute),
+			},
+			targets: []*Target{onNode(1, ""), busy(2, "", time.Hour)},
+			want:    map[string][]int64{"short": {1}},
+		},
+		{
+			name:   "backfill doesn't let long entries delay the head",
+			policy: &Backfill{},
+			entries: []*Entry{
+				withCount(entry("head", time.Hour), 2),
+				entry("long", 2*time.Hour),
+			},
+			targets: []*Target{onNode(1, ""), busy(2, "", time.Hour)},
+			want:    map[string][]int64{},
+		},
+		{
+			name:   "backfill gives long entries the targets the head doesn't need",
+			policy: &Backfill{},
+			entries: []*Entry{
+				pinned(entry("head", time.Hour), 2),
+				entry("long", 2*time.Hour),
+			},
+			targets: []*Target{onNode(1, ""), busy(2, "", time.Hour)},
+			want:    map[string][]int64{"long": {1}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := started(c.policy.Schedule(c.entries, c.targets, now))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFits(t *testing.T) {
+	window := &Reservation{Start: now.Add(time.Hour), End: now.Add(3 * time.Hour), Users: []string{"member"}}
+	reserved := &Target{ID: 1, FreeAt: now, Reservations: []*Reservation{window}}
+	cases := []struct {
+		name string
+		e    *Entry
+		want bool
+	}{
+		{"member inside the window", &Entry{User: "member", LifeTime: 2 * time.Hour}, true},
+		{"others overlapping the window", &Entry{User: "other", LifeTime: 2 * time.Hour}, false},
+		{"others ending before the window", &Entry{User: "other", LifeTime: time.Hour}, true},
+		{"pinned elsewhere", &Entry{User: "member", LifeTime: time.Hour, Targets: []int64{2}}, false},
+		{"pinned here", &Entry{User: "member", LifeTime: time.Hour, Targets: []int64{2, 1}}, true},
+	}
+	for _, c := range cases {
+		if got := c.e.Fits(reserved, now); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.want)
+		}
+	}
+	// once the window is over it keeps nobody out
+	if !(&Entry{User: "other", LifeTime: time.Hour}).Fits(reserved, now.Add(3*time.Hour)) {
+		t.Error("a window that ended still applies")
+	}
+}
+
+func TestForecast(t *testing.T) {
+	a, b, c := entry("a", time.Hour), entry("b", 30*time.Minute), entry("c", time.Hour)
+	targets := []*Target{{ID: 1, FreeAt: now.Add(15 * time.Minute)}, {ID: 2, FreeAt: now}}
+	got := Forecast(&FIFO{}, []*Entry{a, b, c}, targets, now)
+	want := map[*Entry]time.Time{
+		a: now,
+		b: now.Add(15 * time.Minute),
+		c: now.Add(45 * time.Minute),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if targets[0].FreeAt != now.Add(15*time.Minute) {
+		t.Error("Forecast modified its input")
+	}
+	// a reservation start is a point in time to schedule again at
+	window := &Reservation{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Users: []string{"d"}}
+	d := entry("d", 30*time.Minute)
+	got = Forecast(&FIFO{}, []*Entry{d}, []*Target{{ID: 1, FreeAt: now, Reservations: []*Reservation{window}}}, now)
+	if got[d] != now {
+		t.Errorf("member starts at %v", got[d])
+	}
+	e := entry("e", 2*time.Hour)
+	got = Forecast(&FIFO{}, []*Entry{e}, []*Target{{ID: 1, FreeAt: now, Reservations: []*Reservation{window}}}, now)
+	if got[e] != now.Add(2*time.Hour) {
+		t.Errorf("non-member overlapping the window starts at %v", got[e])
+	}
+	if Forecast(&FIFO{}, []*Entry{a}, nil, now) != nil {
+		t.Error("forecast without targets")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	want := []string{"backfill", "bin-packing", "fair-share", "fifo", "priority"}
+	if got := Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := Get("nope"); err == nil {
+		t.Error("unknown scheduler found")
+	}
+	if u, ok := interface{}(&FairShare{}).(UsageAware); !ok || !u.UsesUsage() {
+		t.Error("fair-share doesn't ask for usage")
+	}
+	if _, ok := interface{}(&FIFO{}).(UsageAware); ok {
+		t.Error("fifo asks for usage")
+	}
+}
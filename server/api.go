@@ -9,43 +9,104 @@ type GeneralResponse struct {
 
 type UserPut struct {
 	Name    string         `json:"name"`
-	Role    string         `json:"role"` // admin, user, banned
+	Role    string         `json:"role"` // name of a role, see RoleGet
 	Balance map[string]int `json:"balance"`
 }
 
+type UserGet struct {
+	Name        string               `json:"name"`
+	Role        string               `json:"role"`
+	Source      string               `json:"source,omitempty"`
+	Permissions []string             `json:"permissions"` // of its role
+	Balance     map[string]int       `json:"balance"`
+	Quota       *QuotaGet            `json:"quota"`
+	TypeQuotas  map[string]*QuotaGet `json:"type-quotas"` // only types with a quota of their own
+}
+
+// QuotaGet holds limits, 0 or empty meaning no limit, and the current usage.
+type QuotaGet struct {
+	MaxActive    int    `json:"max-active"`
+	MaxQueued    int    `json:"max-queued"`
+	MaxInstances int    `json:"max-instances"`
+	MaxLifeTime  string `json:"max-life-time"`
+	Active       int    `json:"active"`
+	Queued       int    `json:"queued"`
+	Instances    int    `json:"instances"`
+}
+
 type TokenPut struct {
-	Name   string `json:"name"`
-	Secret string `json:"secret"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`  // those of the token used for the request when empty
+	Expires time.Time `json:"expires"` // never when zero, at most that of the token used
 }
 
-type TokenGet []struct {
-	Name string `json:"name"`
+// TokenSecretGet is the only time the secret of a new token is shown, only
+// its hash is kept.
+type TokenSecretGet struct {
+	Name    string    `json:"name"`
+	Secret  string    `json:"secret"`
+	Expires time.Time `json:"expires"`
+}
+
+type TokenGet []*TokenInfoGet
+
+type TokenInfoGet struct {
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"` // empty means any
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last-used"`
+	LastIP   string    `json:"last-ip"`
+	Creation time.Time `json:"creation"`
 }
 
 type TaskPost struct {
 	Name         string `json:"name"`
 	InstanceType string `json:"instance-type"`
+	Count        int    `json:"count"` // instances started together on distinct targets, 1 when omitted
 }
 
 type TaskStatePost struct {
-	Status   string `json:"status"`
-	LifeTime string `json:"life-time"`
+	Status   string `json:"status"`    // active, or inactive to cancel a queued or held task
+	LifeTime string `json:"life-time"` // lifetime to activate for, or to add to an active task
+	Target   int64  `json:"target"`    // target to activate on, any when 0
+	// run at the spot price, the task is stopped when a normal task needs
+	// its targets
+	Preemptible bool `json:"preemptible"`
+	// hold the task until the last activation of each of these tasks of the
+	// same user has completed, then queue it
+	After []string `json:"after"`
 }
 
 type TaskGet struct {
 	Name         string    `json:"name"`
 	Instance     string    `json:"instance"`
+	Instances    []string  `json:"instances"`
+	Count        int       `json:"count"`
 	InstanceType string    `json:"instance-type"`
 	Status       string    `json:"status"`
+	Preemptible  bool      `json:"preemptible"`
 	Creation     time.Time `json:"creation"`
 	QueueTime    time.Time `json:"queue-time"`
 	EndTime      time.Time `json:"end-time"`
+	After        []string  `json:"after"`     // tasks the last held activation waited for
+	Completed    time.Time `json:"completed"` // when an activation last completed
+}
+
+type PipelineTaskGet struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	After     []string  `json:"after"`
+	Completed time.Time `json:"completed"`
 }
 
 type InstanceTypeGet struct {
 	Name        string         `json:"name"`
 	Description string         `json:"description"`
 	Price       map[string]int `json:"price"`
+	SpotPrice   map[string]int `json:"spot-price"`
+	IdleAfter   string         `json:"idle-after"`
+	IdleCPU     float64        `json:"idle-cpu"`
+	IdleNetwork int64          `json:"idle-network"`
 }
 
 type InstanceTypePut struct {
@@ -53,6 +114,12 @@ type InstanceTypePut struct {
 	Description string         `json:"description"`
 	Configure   string         `json:"configure"`
 	Price       map[string]int `json:"price"`
+	SpotPrice   map[string]int `json:"spot-price"` // preemptible tasks are not allowed when empty
+	// stop tasks whose instances all use less than idle-cpu cores and
+	// idle-network bytes per second for idle-after, never when empty
+	IdleAfter   string  `json:"idle-after"`
+	IdleCPU     float64 `json:"idle-cpu"`
+	IdleNetwork int64   `json:"idle-network"`
 }
 
 type InstanceStatePut struct {
@@ -71,3 +138,102 @@ type InstanceStateGet struct {
 type QueueTimeGet struct {
 	Duration string `json:"duration"`
 }
+
+type TaskQueueGet struct {
+	Position int       `json:"position"` // 1 for the next task to start
+	Start    time.Time `json:"start"`    // projected start
+	Wait     string    `json:"wait"`
+}
+
+type LeaseGet struct {
+	Name    string    `json:"name"`
+	Holder  string    `json:"holder"`
+	Token   int64     `json:"token"`
+	Expire  time.Time `json:"expire"`
+	Renewed time.Time `json:"renewed"`
+	Self    bool      `json:"self"` // whether the answering process holds the lease
+}
+
+type TaskEventGet struct {
+	Actor  string    `json:"actor"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+type TransactionGet struct {
+	Id       int64     `json:"id"`
+	Currency string    `json:"currency"`
+	Amount   int       `json:"amount"`
+	Kind     string    `json:"kind"` // debit, credit, refund, adjustment
+	Task     string    `json:"task"`
+	Actor    string    `json:"actor"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+type TransactionPost struct {
+	Amount map[string]int `json:"amount"`
+	Kind   string         `json:"kind"` // credit or adjustment
+	Reason string         `json:"reason"`
+}
+
+type ReservationPost struct {
+	InstanceType string    `json:"instance-type"`
+	Count        int       `json:"count"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Users        []string  `json:"users"`
+	Description  string    `json:"description"`
+}
+
+type ReservationGet struct {
+	Id           int64     `json:"id"`
+	InstanceType string    `json:"instance-type"`
+	Count        int       `json:"count"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Users        []string  `json:"users"`
+	Targets      []int64   `json:"targets"`
+	Released     bool      `json:"released"`
+	Description  string    `json:"description"`
+	Creator      string    `json:"creator"`
+	Creation     time.Time `json:"creation"`
+}
+
+// SchedulePost creates or replaces a schedule.
+type SchedulePost struct {
+	Task     string `json:"task"`
+	Cron     string `json:"cron"`      // five fields or a descriptor like @daily, in server time
+	LifeTime string `json:"life-time"` // lifetime of every activation
+	Missed   string `json:"missed"`    // skip (default) or catch-up
+}
+
+type ScheduleGet struct {
+	Id         int64     `json:"id"`
+	Task       string    `json:"task"`
+	Cron       string    `json:"cron"`
+	LifeTime   string    `json:"life-time"`
+	Missed     string    `json:"missed"`
+	NextRun    time.Time `json:"next-run"`
+	LastRun    time.Time `json:"last-run"`
+	LastResult string    `json:"last-result"`
+	Creation   time.Time `json:"creation"`
+}
+
+// RolePut creates or replaces a role. The permissions are those of
+// models.Permissions.
+type RolePut struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Description string   `json:"description"`
+}
+
+type RoleGet struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Description string   `json:"description"`
+	Builtin     bool     `json:"builtin"` // may not be deleted
+	Users       int64    `json:"users"`   // that have it
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"log"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+// permit is what a route asks of the role of a user. On its own tasks,
+// instances and account a user needs own, "" letting in every user, banned
+// ones too. On those of anyone, and on routes about nothing a user owns, it
+// needs any, through a token allowing admin.
+type permit struct {
+	own   string
+	any   string
+	owned bool // whether the route is about something a user owns
+	// the task in the path may be deleted, its events then tell whose it was
+	history bool
+}
+
+// ownOr permits users to act on what they own with perm, and on what anyone
+// owns with any.
+func ownOr(perm string, any string) permit {
+	return permit{own: perm, any: any, owned: true}
+}
+
+// only permits the users with perm.
+func only(perm string) permit {
+	return permit{any: perm}
+}
+
+// historyOr is ownOr for the history of a task, which outlives the task.
+func historyOr(perm string, any string) permit {
+	return permit{own: perm, any: any, owned: true, history: true}
+}
+
+// everyone permits every user.
+var everyone = permit{owned: true}
+
+// findRole returns the role with a name, the builtin ones being there until
+// init-db stores them.
+func (s *Server) findRole(name string) (*models.Role, bool, error) {
+	r := &models.Role{Name: name}
+	ok, err := s.orm.Get(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		return r, true, nil
+	}
+	if b := models.BuiltinRole(name); b != nil {
+		return b, true, nil
+	}
+	return nil, false, nil
+}
+
+// roleGet shows a role with the number of users having it.
+func roleGet(r *models.Role, users int64) *RoleGet {
+	return &RoleGet{
+		Name:        r.Name,
+		Permissions: r.Permissions,
+		Description: r.Description,
+		Builtin:     models.BuiltinRole(r.Name) != nil,
+		Users:       users,
+	}
+}
+
+// authorize checks that a token allows scope and that the role of its user
+// permits acting on the task, instance and user given, those that are not
+// empty. It returns the role when it does.
+func (s *Server) authorize(tok *models.Token, scope string, p permit, task string, instance string, requiredUser string) *models.Role {
+	if tok == nil || !tok.Allows(scope) {
+		return nil
+	}
+	u := &models.User{Name: tok.User}
+	ok, err := s.orm.Get(u)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	role, ok, err := s.findRole(u.Role)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return nil
+	}
+	if !ok {
+		// a role that doesn't exist grants nothing
+		role = &models.Role{Name: u.Role}
+	}
+	if p.any != "" && role.Has(p.any) && tok.Allows(models.ScopeAdmin) {
+		return role
+	}
+	if !p.owned {
+		return nil
+	}
+	if p.own != "" && !role.Has(p.own) {
+		return nil
+	}
+	if task != "" {
+		t := &models.Task{Name: task}
+		ok, err := s.orm.Get(t)
+		if err != nil {
+			log.Println("ERROR:", err)
+			return nil
+		}
+		if !ok {
+			if !p.history {
+				return nil
+			}
+			ok, err = s.orm.Exist(&models.TaskEvent{Task: task, User: u.Name})
+			if err != nil {
+				log.Println("ERROR:", err)
+				return nil
+			}
+			if !ok {
+				return nil
+			}
+		} else if t.User != u.Name {
+			return nil
+		}
+	}
+	if instance != "" {
+		t, ok, err := s.taskOfInstance(instance)
+		if err != nil {
+			log.Println("ERROR:", err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if t.User != u.Name {
+			return nil
+		}
+		if t.Status != models.TaskActive {
+			return nil
+		}
+	}
+	if requiredUser != "" {
+		if requiredUser != u.Name {
+			return nil
+		}
+	}
+	return role
+}
+
+// filterAuth lets requests through whose token allows scope and whose user's
+// role permits them, see permit.
+func (s *Server) filterAuth(p permit, scope string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, fc *restful.FilterChain) {
+		ins, ok := req.PathParameters()["instance"]
+		if !ok {
+			ins = ""
+		}
+		task, ok := req.PathParameters()["task"]
+		if !ok {
+			task = ""
+		}
+		tokenName := req.HeaderParameter("X-Token-Name")
+		tokenSecret := req.HeaderParameter("X-Token-Secret")
+		if tokenName == "" {
+			tokenName = req.QueryParameter("token-name")
+			tokenSecret = req.QueryParameter("token-secret")
+		}
+		user, ok := req.PathParameters()["user"]
+		if !ok {
+			user = ""
+		}
+		tok := s.credentialToToken(tokenName, tokenSecret, remoteIP(req.Request))
+		if tok != nil {
+			req.SetAttribute("user", tok.User)
+			req.SetAttribute("token", tok)
+		}
+		role := s.authorize(tok, scope, p, task, ins, user)
+		if role == nil {
+			resp.WriteErrorString(403, "Access Denied")
+			return
+		}
+		req.SetAttribute("role", role)
+		fc.ProcessFilter(req, resp)
+	}
+}
+
+// mayGrant checks that the role of the request grants everything roles do,
+// so that nobody hands out more than it has.
+func mayGrant(req *restful.Request, roles ...*models.Role) error {
+	actor, ok := req.Attribute("role").(*models.Role)
+	if !ok {
+		return newStatusError(403, "no role")
+	}
+	for _, r := range roles {
+		if !actor.Covers(r) {
+			return newStatusError(403, "role "+actor.Name+" lacks permissions of role "+r.Name)
+		}
+	}
+	return nil
+}
+
+// mayActFor checks that the request may act on the account of user, which
+// takes a role granting everything the user's role does unless it is its own.
+func (s *Server) mayActFor(req *restful.Request, user string) error {
+	if actorOf(req) == user {
+		return nil
+	}
+	u := &models.User{Name: user}
+	ok, err := s.orm.Get(u)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUserNotFound
+	}
+	role, ok, err := s.findRole(u.Role)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// a role that doesn't exist grants nothing
+		role = &models.Role{Name: u.Role}
+	}
+	return mayGrant(req, role)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+// authzServer has alice and bob using tasks, the admin root, the banned eve
+// and vera viewing everyone's tasks through a stored role.
+func authzServer(t *testing.T) *Server {
+	s, _ := newTestServer(t)
+	insert(t, s,
+		&models.Role{Name: "viewer", Permissions: []string{models.PermUse, models.PermViewTasks}},
+		&models.Role{Name: "manager", Permissions: []string{models.PermUse, models.PermManageUsers}},
+		&models.User{Name: "alice", Role: "user"},
+		&models.User{Name: "bob", Role: "user"},
+		&models.User{Name: "root", Role: "admin"},
+		&models.User{Name: "eve", Role: "banned"},
+		&models.User{Name: "vera", Role: "viewer"},
+		&models.User{Name: "max", Role: "manager"},
+		&models.User{Name: "nora", Role: "gone"},
+		&models.Task{Name: "a", User: "alice", InstanceType: "x", Status: models.TaskActive, Instance: "a-0", Instances: []string{"a-0", "a-1"}},
+		&models.Task{Name: "a-idle", User: "alice", InstanceType: "x", Status: models.TaskInactive, Instance: "a-idle-0"},
+		&models.Task{Name: "e", User: "eve", InstanceType: "x", Status: models.TaskInactive},
+		&models.Task{Name: "b", User: "bob", InstanceType: "x", Status: models.TaskActive, Instance: "b-0"},
+		&models.TaskEvent{Task: "deleted", User: "alice", From: models.TaskDeleting, To: models.TaskDeleted},
+	)
+	return s
+}
+
+func TestAuthorize(t *testing.T) {
+	s := authzServer(t)
+	view := ownOr(models.PermUse, models.PermViewTasks)
+	cases := []struct {
+		name     string
+		user     string
+		scopes   []string
+		scope    string
+		p        permit
+		task     string
+		instance string
+		account  string
+		ok       bool
+	}{
+		{"own task", "alice", nil, models.ScopeTaskRead, view, "a", "", "", true},
+		{"other's task", "alice", nil, models.ScopeTaskRead, view, "b", "", "", false},
+		{"missing task", "alice", nil, models.ScopeTaskRead, view, "nope", "", "", false},
+		{"admin on other's task", "root", nil, models.ScopeTaskRead, view, "b", "", "", true},
+		{"admin without the admin scope", "root", []string{models.ScopeTaskRead}, models.ScopeTaskRead, view, "b", "", "", false},
+		{"stored role on other's task", "vera", []string{models.ScopeTaskRead, models.ScopeAdmin}, models.ScopeTaskRead, view, "b", "", "", true},
+		{"stored role lacking the permission", "vera", nil, models.ScopeTaskWrite, ownOr(models.PermUse, models.PermManageTasks), "b", "", "", false},
+		{"banned on own task", "eve", nil, models.ScopeTaskRead, view, "e", "", "", false},
+		{"banned on own account", "eve", nil, models.ScopeTaskRead, everyone, "", "", "eve", true},
+		{"unknown role", "nora", nil, models.ScopeTaskRead, view, "", "", "nora", false},
+		{"scope not allowed", "alice", []string{models.ScopeTaskRead}, models.ScopeTaskWrite, view, "a", "", "", false},
+		{"scope allowed", "alice", []string{models.ScopeTaskRead, models.ScopeTaskWrite}, models.ScopeTaskWrite, view, "a", "", "", true},
+		{"own instance", "alice", nil, models.ScopeConsole, view, "", "a-1", "", true},
+		{"own instance not active", "alice", nil, models.ScopeConsole, view, "", "a-idle-0", "", false},
+		{"other's instance", "alice", nil, models.ScopeConsole, view, "", "b-0", "", false},
+		{"history of own deleted task", "alice", nil, models.ScopeTaskRead, historyOr(models.PermUse, models.PermViewTasks), "deleted", "", "", true},
+		{"history of other's deleted task", "bob", nil, models.ScopeTaskRead, historyOr(models.PermUse, models.PermViewTasks), "deleted", "", "", false},
+		{"deleted task without history", "alice", nil, models.ScopeTaskRead, view, "deleted", "", "", false},
+		{"own account", "alice", nil, models.ScopeTaskRead, ownOr(models.PermUse, models.PermManageUsers), "", "", "alice", true},
+		{"other's account", "alice", nil, models.ScopeTaskRead, ownOr(models.PermUse, models.PermManageUsers), "", "", "bob", false},
+		{"manager on other's account", "max", nil, models.ScopeTaskRead, ownOr(models.PermUse, models.PermManageUsers), "", "", "bob", true},
+		{"only, without the permission", "alice", nil, models.ScopeTaskRead, only(models.PermManageUsers), "", "", "", false},
+		{"only, with the permission", "max", nil, models.ScopeTaskRead, only(models.PermManageUsers), "", "", "", true},
+		{"unknown user", "nobody", nil, models.ScopeTaskRead, everyone, "", "", "", false},
+	}
+	for _, c := range cases {
+		tok := &models.Token{Name: c.user + "-token", User: c.user, Scopes: c.scopes}
+		role := s.authorize(tok, c.scope, c.p, c.task, c.instance, c.account)
+		if (role != nil) != c.ok {
+			t.Errorf("%v: got %v, want %v", c.name, role != nil, c.ok)
+		}
+	}
+	if s.authorize(nil, models.ScopeTaskRead, everyone, "", "", "") != nil {
+		t.Error("no token: authorized")
+	}
+}
+
+func TestMayActFor(t *testing.T) {
+	s := authzServer(t)
+	cases := []struct {
+		actor string
+		user  string
+		code  int // of the error, 0 for none
+	}{
+		{"eve", "eve", 0},
+		{"max", "bob", 0},
+		{"max", "max", 0},
+		{"max", "root", 403},
+		{"max", "vera", 403},
+		{"max", "nora", 0}, // a role that doesn't exist grants nothing
+		{"max", "nobody", 404},
+		{"root", "vera", 0},
+	}
+	for _, c := range cases {
+		u := &models.User{Name: c.actor}
+		if _, err := s.orm.Get(u); err != nil {
+			t.Fatal(err)
+		}
+		role, _, err := s.findRole(u.Role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := restful.NewRequest(httptest.NewRequest("PUT", "/", nil))
+		req.SetAttribute("user", c.actor)
+		req.SetAttribute("role", role)
+		err = s.mayActFor(req, c.user)
+		if c.code == 0 && err != nil {
+			t.Errorf("%v for %v: %v", c.actor, c.user, err)
+		}
+		if se, ok := err.(*statusError); c.code != 0 && (!ok || se.status != c.code) {
+			t.Errorf("%v for %v: got %v, want %v", c.actor, c.user, err, c.code)
+		}
+	}
+}
@@ -3,28 +3,63 @@ package server
 import (
 	"log"
 	"time"
-
-	"github.com/lcpu-dev/vmsched/models"
 )
 
+// StartCron runs the periodic passes, doing work only while holding the cron lease.
 func (s *Server) StartCron() {
-	ticker := time.NewTicker(s.conf.CronInterval)
+	go s.leader.Run()
 	for {
-		<-ticker.C
-		tasks := []*models.Task{}
-		err := s.orm.Where("status = ?", "active").And("end_time < ?", time.Now().Add(-30*time.Second)).Find(&tasks)
-		if err != nil {
+		next, err := s.runCron()
+		if err != nil && err != errNotLeader {
 			log.Println("ERROR:", err)
-			continue
 		}
-		for _, task := range tasks {
-			if task.EndTime.After(time.Now().Add(-30 * time.Second)) {
-				continue
-			}
-			err = s.killTask(task)
-			if err != nil {
-				log.Println("ERROR:", err)
-			}
+		s.expiry.wait(next)
+	}
+}
+
+func (s *Server) runCron() (next time.Time, err error) {
+	err = s.leader.Fence()
+	if err != nil {
+		return
+	}
+	if time.Since(s.reconciled) >= s.conf.Reconcile.Interval {
+		err = s.reconcile()
+		if err != nil {
+			log.Println("ERROR:", err)
 		}
+		s.reconciled = time.Now()
+	}
+	err = s.syncDirectory()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	err = s.deleteExpiredSessions()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	err = s.stopIdle()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	next, err = s.expiry.expire()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	err = s.releaseReservations()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	err = s.releaseHeld()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	nextRun, err := s.runSchedules()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	if !nextRun.IsZero() && (next.IsZero() || nextRun.Before(next)) {
+		next = nextRun
 	}
+	err = s.dispatchQueues()
+	return
 }
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emicklei/go-restful/v3"
+	"xorm.io/xorm"
+)
+
+// statusError is an error that maps to a specific response. Business errors
+// keep the 200 + Success=false convention of the rest of the API.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+func newStatusError(status int, message string) *statusError {
+	return &statusError{status: status, message: message}
+}
+
+var (
+	errConflict           = newStatusError(409, "concurrent modification, please retry")
+	errPreconditionFailed = newStatusError(412, "resource has been modified")
+	errTaskNotFound       = newStatusError(404, "task not found")
+	errUserNotFound       = newStatusError(404, "user not found")
+	errTypeNotFound       = newStatusError(404, "instance type not found")
+	errLowBalance         = newStatusError(200, "balance is low")
+	errNotInQueue         = newStatusError(404, "task is not in the queue")
+	errNoTargets          = newStatusError(404, "instance type has no targets")
+	errScheduleNotFound   = newStatusError(404, "schedule not found")
+	errRoleNotFound       = newStatusError(404, "role not found")
+	errNeverStarts        = newStatusError(200, "the scheduler would never start it on the current targets")
+)
+
+func writeError(resp *restful.Response, err error) {
+	if se, ok := err.(*statusError); ok {
+		resp.WriteHeaderAndEntity(se.status, &GeneralResponse{Success: false, Message: se.message})
+		return
+	}
+	resp.WriteError(500, err)
+}
+
+const maxConflictRetries = 5
+
+// retryOnConflict runs fn again, up to a limit, while it fails with
+// errConflict. fn must re-read everything it writes.
+func retryOnConflict(fn func() error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		err = fn()
+		if err != errConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// update writes a bean with a version column to the row with primary key id
+// and returns errConflict when the row was changed since the bean was read.
+// Every column but the version and creation ones is written, zero values too,
+// so the bean must be a whole row unless the session picks columns with Cols.
+func update(session xorm.Interface, bean interface{}, id interface{}) error {
+	affectedRows, err := session.ID(id).UseBool().AllCols().Update(bean)
+	if err != nil {
+		return err
+	}
+	if affectedRows <= 0 {
+		return errConflict
+	}
+	return nil
+}
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// matchETag checks an If-Match header against the current version, an empty
+// header always matches.
+func matchETag(ifMatch string, version int) bool {
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
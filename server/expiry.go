@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+// expiry terminates active tasks once the EndTime stored in the database has
+// passed. The database is the only source of truth, so pending expirations
+// survive restarts and lifetime changes only need a Notify.
+type expiry struct {
+	s    *Server
+	wake chan struct{}
+}
+
+func newExpiry(s *Server) *expiry {
+	return &expiry{
+		s:    s,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Notify makes the loop re-read the nearest deadline, e.g. after a task was
+// activated or its end time changed.
+func (e *expiry) Notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until next, a Notify or one cron interval, whichever is first.
+func (e *expiry) wait(next time.Time) {
+	wait := e.s.conf.CronInterval
+	if !next.IsZero() && time.Until(next) < wait {
+		wait = time.Until(next)
+	}
+	// don't spin on a task that keeps failing to terminate
+	if wait < time.Second {
+		wait = time.Second
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+	case <-e.wake:
+		timer.Stop()
+	}
+}
+
+// expire kills all overdue tasks and returns the next pending end time, or the
+// zero time when no task is active.
+func (e *expiry) expire() (time.Time, error) {
+	tasks := []*models.Task{}
+	err := e.s.orm.Where("status = ?", models.TaskActive).And("end_time <= ?", time.Now()).Find(&tasks)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, task := range tasks {
+		err = e.s.completeTask(task, systemActor, "lifetime expired")
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+	next := &models.Task{}
+	ok, err := e.s.orm.Where("status = ?", models.TaskActive).Asc("end_time").Get(next)
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return next.EndTime, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+// idleTracker keeps the last counters read from every active instance. It
+// lives in the memory of the cron lease holder, a new holder starts over.
+type idleTracker struct {
+	sampled time.Time
+	samples map[string]*idleSample
+}
+
+type idleSample struct {
+	at        time.Time
+	cpu       int64     // CPU time in nanoseconds
+	network   int64     // bytes sent and received
+	idleSince time.Time // zero while the instance is busy
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{samples: map[string]*idleSample{}}
+}
+
+// stopIdle samples the instances of active tasks whose type has an idle
+// policy, once per sample interval, and kills the tasks whose instances have
+// all been idle long enough. Killing refunds the rest of the lifetime.
+func (s *Server) stopIdle() error {
+	if time.Since(s.idle.sampled) < s.conf.Idle.SampleInterval {
+		return nil
+	}
+	now := time.Now()
+	s.idle.sampled = now
+	types := []*models.InstanceType{}
+	err := s.orm.Where("idle_after > ?", 0).Find(&types)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, it := range types {
+		tasks := []*models.Task{}
+		err = s.orm.Find(&tasks, &models.Task{InstanceType: it.Name, Status: models.TaskActive})
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			idle := true
+			since := time.Time{}
+			for _, instance := range t.AllInstances() {
+				seen[instance] = true
+				sample, err := s.sampleInstance(instance, now, t.ActiveTime, it)
+				if err != nil {
+					log.Println("ERROR:", err)
+					idle = false
+					continue
+				}
+				if sample.idleSince.IsZero() {
+					idle = false
+					continue
+				}
+				if sample.idleSince.After(since) {
+					since = sample.idleSince
+				}
+			}
+			if !idle || now.Sub(since) < it.IdleAfter {
+				continue
+			}
+			err = s.killTask(t, systemActor, "idle since "+since.Format(time.RFC3339))
+			if err != nil {
+				log.Println("ERROR:", err)
+			}
+		}
+	}
+	for instance := range s.idle.samples {
+		if !seen[instance] {
+			delete(s.idle.samples, instance)
+		}
+	}
+	return nil
+}
+
+// sampleInstance reads the counters of an instance and compares them with the
+// previous sample. An instance is busy until two samples of the current
+// activation show otherwise.
+func (s *Server) sampleInstance(instance string, now time.Time, activeTime time.Time, it *models.InstanceType) (*idleSample, error) {
+	state, _, err := s.lxd.GetInstanceState(instance)
+	if err != nil {
+		return nil, err
+	}
+	cur := &idleSample{at: now, cpu: state.CPU.Usage}
+	for name, n := range state.Network {
+		if name == "lo" {
+			continue
+		}
+		cur.network += n.Counters.BytesReceived + n.Counters.BytesSent
+	}
+	prev, ok := s.idle.samples[instance]
+	s.idle.samples[instance] = cur
+	// counters start over when an instance restarts
+	if !ok || prev.at.Before(activeTime) || cur.cpu < prev.cpu || cur.network < prev.network {
+		return cur, nil
+	}
+	secs := now.Sub(prev.at).Seconds()
+	if secs <= 0 {
+		return cur, nil
+	}
+	cpu := float64(cur.cpu-prev.cpu) / float64(time.Second) / secs
+	network := float64(cur.network-prev.network) / secs
+	if cpu <= it.IdleCPU && network <= float64(it.IdleNetwork) {
+		cur.idleSince = prev.idleSince
+		if cur.idleSince.IsZero() {
+			cur.idleSince = prev.at
+		}
+	}
+	return cur, nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// instanceState reports cpu seconds of CPU time, bytes on eth0 and lo bytes
+// on the loopback.
+func instanceState(cpu int64, bytes int64, lo int64) *api.InstanceState {
+	return &api.InstanceState{
+		CPU: api.InstanceStateCPU{Usage: cpu * int64(time.Second)},
+		Network: map[string]api.InstanceStateNetwork{
+			"eth0": {Counters: api.InstanceStateNetworkCounters{BytesReceived: bytes / 2, BytesSent: bytes - bytes/2}},
+			"lo":   {Counters: api.InstanceStateNetworkCounters{BytesReceived: lo, BytesSent: lo}},
+		},
+	}
+}
+
+func TestSampleInstance(t *testing.T) {
+	s, fake := newTestServer(t)
+	it := &models.InstanceType{Name: "x", IdleAfter: time.Hour, IdleCPU: 0.1, IdleNetwork: 100}
+	start := now.Add(-time.Hour)
+	steps := []struct {
+		name      string
+		cpu       int64 // seconds
+		bytes     int64
+		lo        int64
+		idleSince time.Duration // since start, -1 when busy
+	}{
+		{"first sample", 0, 0, 0, -1},
+		{"idle", 1, 600, 0, 1 * time.Minute},
+		{"still idle, loopback traffic aside", 2, 1200, 1e9, 1 * time.Minute},
+		{"busy CPU", 32, 1200, 1e9, -1},
+		{"busy network", 33, 1e6, 1e9, -1},
+		{"idle again", 33, 1e6, 1e9, 5 * time.Minute},
+		{"restarted", 1, 0, 0, -1},
+		{"idle after the restart", 2, 0, 0, 7 * time.Minute},
+	}
+	for i, step := range steps {
+		fake.states["i-0"] = instanceState(step.cpu, step.bytes, step.lo)
+		at := start.Add(time.Duration(i+1) * time.Minute)
+		sample, err := s.sampleInstance("i-0", at, start, it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := time.Time{}
+		if step.idleSince >= 0 {
+			want = start.Add(step.idleSince)
+		}
+		if !sample.idleSince.Equal(want) {
+			t.Errorf("%v: idle since %v, want %v", step.name, sample.idleSince, want)
+		}
+	}
+	// samples of an activation before don't count
+	fake.states["i-0"] = instanceState(2, 0, 0)
+	sample, err := s.sampleInstance("i-0", now.Add(time.Hour), now.Add(time.Minute), it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sample.idleSince.IsZero() {
+		t.Errorf("new activation idle since %v", sample.idleSince)
+	}
+}
+
+func TestStopIdle(t *testing.T) {
+	s, fake := newTestServer(t)
+	insert(t, s,
+		&models.User{Name: "alice", Balance: map[string]int{"CNY": 0}},
+		&models.InstanceType{Name: "x", IdleAfter: 30 * time.Minute, IdleCPU: 0.1},
+		&models.InstanceType{Name: "y"},
+	)
+	cases := []struct {
+		task      string
+		typ       string
+		cpu       int64         // seconds since the last sample
+		idleSince time.Duration // ago, when the last sample was idle
+		stopped   bool
+	}{
+		{"idle", "x", 0, 40 * time.Minute, true},
+		{"busy now", "x", 60, 40 * time.Minute, false},
+		{"not long enough", "x", 0, 10 * time.Minute, false},
+		{"no idle policy", "y", 0, 40 * time.Minute, false},
+	}
+	for i, c := range cases {
+		task := running(c.task, int64(i+1), 2*time.Hour, false)
+		task.InstanceType = c.typ
+		insert(t, s, task, &models.InstanceTarget{Id: int64(i + 1), Type: c.typ, Status: "busy", Task: c.task, Instance: task.Instance})
+		fake.states[task.Instance] = instanceState(100+c.cpu, 0, 0)
+		s.idle.samples[task.Instance] = &idleSample{at: now.Add(-time.Minute), cpu: 100 * int64(time.Second), idleSince: now.Add(-c.idleSince)}
+	}
+	s.idle.samples["gone-0"] = &idleSample{at: now.Add(-time.Minute)}
+	err := s.stopIdle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		got := getTask(t, s, c.task)
+		if stopped := got.Status == models.TaskInactive; stopped != c.stopped {
+			t.Errorf("%v: %v", c.task, got.Status)
+		}
+	}
+	if len(fake.stopped) != 1 || fake.stopped[0] != "idle-0" {
+		t.Errorf("instances stopped: %v", fake.stopped)
+	}
+	if _, ok := s.idle.samples["gone-0"]; ok {
+		t.Error("sample of a gone instance kept")
+	}
+	// sampled once per interval
+	fake.states["busy now-0"] = instanceState(0, 0, 0)
+	if err := s.stopIdle(); err != nil || s.idle.samples["busy now-0"].cpu == 0 {
+		t.Errorf("sampled again within the interval: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/utils/directory"
+	"xorm.io/xorm"
+)
+
+// ldapActor is recorded for what directory logins and syncs do, and as the
+// source of the users they create.
+const ldapActor = "ldap"
+
+// ldapLoginTTL is how long a checked password is trusted without binding to
+// the directory again, WebDAV clients send it with every request.
+const ldapLoginTTL = time.Minute
+
+// ldapMaxFailures failed logins of a user, or from an address, within
+// ldapFailureWindow keep them from binding to the directory until the window
+// is over, so that passwords can't be guessed through us.
+const (
+	ldapMaxFailures   = 5
+	ldapFailureWindow = 5 * time.Minute
+)
+
+type ldapLogins struct {
+	mu       sync.Mutex
+	logins   map[string]*ldapLogin
+	failures map[string]*ldapFailures // by "user " or "ip " and the name
+}
+
+type ldapLogin struct {
+	hash    [sha256.Size]byte
+	expires time.Time
+}
+
+type ldapFailures struct {
+	count int
+	since time.Time
+}
+
+func newLDAPLogins() *ldapLogins {
+	return &ldapLogins{logins: map[string]*ldapLogin{}, failures: map[string]*ldapFailures{}}
+}
+
+func failureKeys(user string, ip string) []string {
+	return []string{"user " + user, "ip " + ip}
+}
+
+// blocked reports whether a user, or the address it comes from, failed too
+// often lately.
+func (l *ldapLogins) blocked(user string, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, k := range failureKeys(user, ip) {
+		f, ok := l.failures[k]
+		if ok && f.count >= ldapMaxFailures && now.Sub(f.since) < ldapFailureWindow {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ldapLogins) failed(user string, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, f := range l.failures {
+		if now.Sub(f.since) >= ldapFailureWindow {
+			delete(l.failures, k)
+		}
+	}
+	for _, k := range failureKeys(user, ip) {
+		f, ok := l.failures[k]
+		if !ok {
+			f = &ldapFailures{since: now}
+			l.failures[k] = f
+		}
+		f.count++
+		if f.count == ldapMaxFailures {
+			log.Println("too many failed directory logins of", k, "since", f.since.Format(time.RFC3339))
+		}
+	}
+}
+
+func (l *ldapLogins) valid(user string, password string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	login, ok := l.logins[user]
+	if !ok || time.Now().After(login.expires) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(hash[:], login.hash[:]) == 1
+}
+
+func (l *ldapLogins) remember(user string, password string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for u, login := range l.logins {
+		if now.After(login.expires) {
+			delete(l.logins, u)
+		}
+	}
+	l.logins[user] = &ldapLogin{hash: sha256.Sum256([]byte(password)), expires: now.Add(ldapLoginTTL)}
+	// the address keeps its failures, one good login of its own doesn't
+	// buy it more guesses at others
+	delete(l.failures, "user "+user)
+}
+
+func (l *ldapLogins) forget(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.logins, user)
+}
+
+// directoryLogin checks a user name and password from an address against the
+// directory and returns a token standing for the user, which is not stored.
+// The user is created on its first login and gets the role of its groups on
+// every one.
+func (s *Server) directoryLogin(user string, password string, ip string) *models.Token {
+	if s.dir == nil || user == "" || password == "" {
+		return nil
+	}
+	tok := &models.Token{Name: user, User: user}
+	if s.ldapLogins.valid(user, password) {
+		return tok
+	}
+	if s.ldapLogins.blocked(user, ip) {
+		return nil
+	}
+	entry, err := s.dir.Authenticate(user, password)
+	if err == directory.ErrInvalidCredentials {
+		s.ldapLogins.failed(user, ip)
+		return nil
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		return nil
+	}
+	role := s.dir.Role(entry)
+	if role == "" {
+		log.Println("user", user, "is in none of the directory groups with a role")
+		return nil
+	}
+	err = s.setDirectoryRole(user, role, true)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return nil
+	}
+	s.ldapLogins.remember(user, password)
+	return tok
+}
+
+// directoryName reports whether a user name may log in through the directory,
+// a token of that name would keep it from doing so.
+func (s *Server) directoryName(name string) (bool, error) {
+	if s.dir == nil {
+		return false, nil
+	}
+	ok, err := s.orm.Exist(&models.User{Name: name})
+	if err != nil || ok {
+		return ok, err
+	}
+	entries, err := s.dir.LookupAll([]string{name})
+	if err != nil {
+		return false, err
+	}
+	return entries[name] != nil, nil
+}
+
+// setDirectoryRole gives a user from the directory the role of its groups,
+// creating it when create is set. Users from elsewhere are left alone, a
+// directory entry of the same name doesn't make them directory users.
+func (s *Server) setDirectoryRole(user string, role string, create bool) error {
+	return retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			u := &models.User{Name: user}
+			ok, err := session.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				if !create {
+					return nil, nil
+				}
+				u.Role = role
+				u.Source = ldapActor
+				return nil, s.createUser(session, u, s.conf.LDAP.Balance, ldapActor)
+			}
+			if u.Source != ldapActor {
+				return nil, newStatusError(403, "user "+user+" is not from the directory")
+			}
+			if u.Role == role {
+				return nil, nil
+			}
+			log.Println("user", user, "is now", role, "after the directory, was", u.Role)
+			u.Role = role
+			return nil, update(session, u, user)
+		})
+		return err
+	})
+}
+
+// syncDirectory reads the groups of the directory users again, once per sync
+// interval. Users gone from the directory, or from every group with a role,
+// are banned.
+func (s *Server) syncDirectory() error {
+	if s.dir == nil || time.Since(s.ldapSynced) < s.conf.LDAP.SyncInterval {
+		return nil
+	}
+	s.ldapSynced = time.Now()
+	users := []*models.User{}
+	err := s.orm.Find(&users, &models.User{Source: ldapActor})
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	entries, err := s.dir.LookupAll(names)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		role := "banned"
+		if e, ok := entries[u.Name]; ok {
+			if r := s.dir.Role(e); r != "" {
+				role = r
+			}
+		}
+		if role == "banned" {
+			s.ldapLogins.forget(u.Name)
+		}
+		if role == u.Role {
+			continue
+		}
+		err = s.setDirectoryRole(u.Name, role, false)
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+	return nil
+}
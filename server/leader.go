@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+const cronLease = "cron"
+
+var errNotLeader = errors.New("not holding the cron lease")
+
+// leader elects a single process to run the cron and dequeue loop through a
+// lease row in the database. Every change of holder increases the lease token,
+// so a process that was paused past its expiry can tell it has been fenced off.
+type leader struct {
+	s      *Server
+	name   string
+	holder string
+
+	mu     sync.Mutex
+	token  int64
+	expire time.Time
+}
+
+func newLeader(s *Server, name string) (*leader, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return &leader{
+		s:      s,
+		name:   name,
+		holder: fmt.Sprintf("%v-%v-%v", host, os.Getpid(), hex.EncodeToString(b)),
+	}, nil
+}
+
+func (l *leader) Run() {
+	ticker := time.NewTicker(l.s.conf.LeaseTTL / 3)
+	for {
+		was := l.IsLeader()
+		ok, err := l.acquire()
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+		if ok && !was {
+			log.Println("acquired lease", l.name, "as", l.holder, "with token", l.currentToken())
+			l.s.expiry.Notify()
+		} else if !ok && was {
+			log.Println("lost lease", l.name)
+		}
+		<-ticker.C
+	}
+}
+
+func (l *leader) currentToken() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+// IsLeader reports whether the lease was held at the last renewal and has not
+// expired since. Use Fence before acting on shared state.
+func (l *leader) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token != 0 && time.Now().Before(l.expire)
+}
+
+// Fence checks against the database that the lease is still ours. It is a
+// best-effort check done once per cron pass: the writes that follow don't
+// carry the token, so a process stalled after Fence may still write once the
+// lease has moved. Those writes are guarded by the version columns and the
+// task state machine, which is what keeps them safe.
+func (l *leader) Fence() error {
+	if !l.IsLeader() {
+		return errNotLeader
+	}
+	token := l.currentToken()
+	ok, err := l.s.orm.Where("name = ? AND holder = ? AND token = ? AND expire > ?", l.name, l.holder, token, time.Now()).Exist(&models.Lease{})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		l.mu.Lock()
+		if l.token == token {
+			l.token = 0
+		}
+		l.mu.Unlock()
+		return errNotLeader
+	}
+	return nil
+}
+
+func (l *leader) acquire() (bool, error) {
+	now := time.Now()
+	expire := now.Add(l.s.conf.LeaseTTL)
+	token := l.currentToken()
+	if token != 0 {
+		affectedRows, err := l.s.orm.Table(&models.Lease{}).
+			Where("name = ? AND holder = ? AND token = ?", l.name, l.holder, token).
+			Update(map[string]interface{}{"expire": expire, "renewed": now})
+		if err != nil {
+			return false, err
+		}
+		if affectedRows > 0 {
+			l.set(token, expire)
+			return true, nil
+		}
+	}
+	ok, err := l.s.orm.Exist(&models.Lease{Name: l.name})
+	if err != nil {
+		l.set(0, time.Time{})
+		return false, err
+	}
+	if !ok {
+		// losing this race to another process is fine, the update below decides
+		l.s.orm.Insert(&models.Lease{Name: l.name})
+	}
+	affectedRows, err := l.s.orm.Table(&models.Lease{}).
+		Where("name = ? AND (expire < ? OR expire IS NULL)", l.name, now).
+		Incr("token").
+		Update(map[string]interface{}{"holder": l.holder, "expire": expire, "renewed": now})
+	if err != nil {
+		l.set(0, time.Time{})
+		return false, err
+	}
+	if affectedRows <= 0 {
+		l.set(0, time.Time{})
+		return false, nil
+	}
+	lease := &models.Lease{Name: l.name}
+	ok, err = l.s.orm.Get(lease)
+	if err != nil {
+		l.set(0, time.Time{})
+		return false, err
+	}
+	if !ok || lease.Holder != l.holder {
+		l.set(0, time.Time{})
+		return false, nil
+	}
+	l.set(lease.Token, expire)
+	return true, nil
+}
+
+func (l *leader) set(token int64, expire time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token = token
+	l.expire = expire
+}
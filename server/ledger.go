@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"xorm.io/xorm"
+)
+
+// postLedger applies signed amounts to the cached balance of a user read
+// through db and appends them to the ledger. Debits fail with errLowBalance
+// instead of taking a balance below zero. Callers run it inside a transaction
+// and retry on errConflict.
+func (s *Server) postLedger(db xorm.Interface, u *models.User, kind string, amounts map[string]int, task string, actor string, reason string) error {
+	if u.Balance == nil {
+		u.Balance = map[string]int{}
+	}
+	changed := false
+	for k, v := range amounts {
+		if v == 0 {
+			continue
+		}
+		if kind == models.LedgerDebit && u.Balance[k]+v < 0 {
+			return errLowBalance
+		}
+		u.Balance[k] += v
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	err := update(db, u, u.Name)
+	if err != nil {
+		return err
+	}
+	for k, v := range amounts {
+		if v == 0 {
+			continue
+		}
+		_, err = db.Insert(&models.LedgerEntry{
+			User:     u.Name,
+			Currency: k,
+			Amount:   v,
+			Kind:     kind,
+			Task:     task,
+			Actor:    actor,
+			Reason:   reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// charge posts a ledger entry for a user in its own transaction, retrying on
+// concurrent balance changes.
+func (s *Server) charge(user string, kind string, amounts map[string]int, task string, actor string, reason string) error {
+	return retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			u := &models.User{Name: user}
+			ok, err := session.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errUserNotFound
+			}
+			return nil, s.postLedger(session, u, kind, amounts, task, actor, reason)
+		})
+		return err
+	})
+}
+
+// unusedRefund computes what a task paid for its current activation but
+// didn't use, counting every started minute as used.
+func unusedRefund(t *models.Task) (map[string]int, int) {
+	paid := int(t.LifeTime / time.Minute)
+	used := 0
+	if !t.ActiveTime.IsZero() && !t.ActiveTime.Before(t.QueueTime) {
+		used = int((time.Since(t.ActiveTime) + time.Minute - 1) / time.Minute)
+	}
+	left := paid - used
+	if left <= 0 {
+		return nil, 0
+	}
+	amounts := map[string]int{}
+	for k, v := range t.Price {
+		amounts[k] = v * left
+	}
+	return amounts, left
+}
+
+// refundUnused credits back the unused part of a task's current activation.
+func (s *Server) refundUnused(db xorm.Interface, t *models.Task, actor string) error {
+	amounts, minutes := unusedRefund(t)
+	if minutes <= 0 {
+		return nil
+	}
+	u := &models.User{Name: t.User}
+	ok, err := db.Get(u)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUserNotFound
+	}
+	return s.postLedger(db, u, models.LedgerRefund, amounts, t.Name, actor, fmt.Sprintf("%v unused minutes", minutes))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+func TestUnusedRefund(t *testing.T) {
+	queued := time.Now().Add(-2 * time.Hour)
+	activation := func(ago time.Duration, lifetime time.Duration) *models.Task {
+		task := &models.Task{QueueTime: queued, LifeTime: lifetime, Price: map[string]int{"CNY": 3, "GPU": 1}}
+		if ago != 0 {
+			task.ActiveTime = time.Now().Add(-ago)
+		}
+		return task
+	}
+	stale := activation(0, time.Hour)
+	stale.ActiveTime = queued.Add(-time.Hour)
+	cases := []struct {
+		name    string
+		task    *models.Task
+		amounts map[string]int
+		minutes int
+	}{
+		{"not started", activation(0, time.Hour), map[string]int{"CNY": 180, "GPU": 60}, 60},
+		{"started activation of before", stale, map[string]int{"CNY": 180, "GPU": 60}, 60},
+		{"started minute is used", activation(30*time.Second, time.Hour), map[string]int{"CNY": 177, "GPU": 59}, 59},
+		{"some minutes", activation(20*time.Minute+30*time.Second, time.Hour), map[string]int{"CNY": 117, "GPU": 39}, 39},
+		{"all used", activation(59*time.Minute+30*time.Second, time.Hour), nil, 0},
+		{"overran", activation(90*time.Minute, time.Hour), nil, 0},
+		{"partial minutes paid", activation(0, 90*time.Second), map[string]int{"CNY": 3, "GPU": 1}, 1},
+	}
+	for _, c := range cases {
+		amounts, minutes := unusedRefund(c.task)
+		if minutes != c.minutes || !reflect.DeepEqual(amounts, c.amounts) {
+			t.Errorf("%v: got %v for %v minutes, want %v for %v", c.name, amounts, minutes, c.amounts, c.minutes)
+		}
+	}
+}
+
+func TestCharge(t *testing.T) {
+	s, _ := newTestServer(t)
+	insert(t, s, &models.User{Name: "alice", Balance: map[string]int{"CNY": 10}})
+	cases := []struct {
+		name    string
+		user    string
+		kind    string
+		amounts map[string]int
+		err     error
+		balance map[string]int
+	}{
+		{"debit", "alice", models.LedgerDebit, map[string]int{"CNY": -4}, nil, map[string]int{"CNY": 6}},
+		{"debit below zero", "alice", models.LedgerDebit, map[string]int{"CNY": -1, "GPU": -1}, errLowBalance, map[string]int{"CNY": 6}},
+		{"credit", "alice", models.LedgerCredit, map[string]int{"GPU": 2}, nil, map[string]int{"CNY": 6, "GPU": 2}},
+		{"nothing", "alice", models.LedgerRefund, map[string]int{"CNY": 0}, nil, map[string]int{"CNY": 6, "GPU": 2}},
+		{"adjustment below zero", "alice", models.LedgerAdjustment, map[string]int{"CNY": -7}, nil, map[string]int{"CNY": -1, "GPU": 2}},
+		{"unknown user", "bob", models.LedgerCredit, map[string]int{"CNY": 1}, errUserNotFound, nil},
+	}
+	for _, c := range cases {
+		err := s.charge(c.user, c.kind, c.amounts, "t", "carol", c.name)
+		if err != c.err {
+			t.Errorf("%v: %v", c.name, err)
+		}
+		if c.user == "alice" && !reflect.DeepEqual(balance(t, s, "alice"), c.balance) {
+			t.Errorf("%v: balance %v, want %v", c.name, balance(t, s, "alice"), c.balance)
+		}
+	}
+	// the ledger explains the balance, without the entries of failed charges
+	entries := []*models.LedgerEntry{}
+	if err := s.orm.Find(&entries); err != nil {
+		t.Fatal(err)
+	}
+	sums := map[string]int{"CNY": 10}
+	for _, e := range entries {
+		if e.User != "alice" || e.Actor != "carol" || e.Task != "t" || e.Amount == 0 {
+			t.Errorf("entry %+v", e)
+		}
+		sums[e.Currency] += e.Amount
+	}
+	if len(entries) != 3 || !reflect.DeepEqual(sums, balance(t, s, "alice")) {
+		t.Errorf("%v entries summing to %v", len(entries), sums)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/lcpu-dev/vmsched/models"
+	"xorm.io/xorm"
+)
+
+// oidcCookie ties a login to the browser that started it.
+const oidcCookie = "vmsched-oidc"
+
+// oidcLoginTTL is how long a login may take at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcActor is recorded for what logins do to the ledger, and as the source
+// of the users they create.
+const oidcActor = "oidc"
+
+// oidcState travels through the provider as the state parameter, signed so
+// that no process of ours has to remember it.
+type oidcState struct {
+	Nonce    string    `json:"nonce"`
+	Redirect string    `json:"redirect"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (s *Server) stateMAC(payload string) []byte {
+	key := sha256.Sum256([]byte("vmsched oidc state\x00" + s.conf.OIDC.ClientSecret))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (s *Server) signState(st *oidcState) (string, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.stateMAC(payload)), nil
+}
+
+func (s *Server) parseState(raw string) (*oidcState, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed state")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.stateMAC(parts[0])) {
+		return nil, errors.New("bad state signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed state")
+	}
+	st := &oidcState{}
+	err = json.Unmarshal(b, st)
+	if err != nil {
+		return nil, errors.New("malformed state")
+	}
+	if time.Now().After(st.Expires) {
+		return nil, errors.New("login took too long")
+	}
+	return st, nil
+}
+
+// redirectAllowed reports whether a login may send the session token to a
+// URL, which must have the scheme and host of an allowed one and a path under
+// its path.
+func (s *Server) redirectAllowed(redirect string) bool {
+	u, err := url.Parse(redirect)
+	// the token goes into the fragment, and browsers resolve dot segments
+	if err != nil || u.User != nil || u.Opaque != "" || u.Fragment != "" || strings.Contains("/"+u.Path+"/", "/../") {
+		return false
+	}
+	for _, allowed := range s.conf.OIDC.AllowedRedirects {
+		a, err := url.Parse(allowed)
+		if err != nil || a.Scheme == "" || a.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, a.Scheme) || !strings.EqualFold(u.Host, a.Host) {
+			continue
+		}
+		if pathUnder(u.EscapedPath(), a.EscapedPath()) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathUnder reports whether a path is prefix or below it.
+func pathUnder(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (s *Server) GetOIDCLogin(req *restful.Request, resp *restful.Response) {
+	redirect := req.QueryParameter("redirect")
+	if redirect != "" && !s.redirectAllowed(redirect) {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "redirect not allowed"})
+		return
+	}
+	nonce, err := models.NewSecret()
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	state, err := s.signState(&oidcState{
+		Nonce:    nonce,
+		Redirect: redirect,
+		Expires:  time.Now().Add(oidcLoginTTL),
+	})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	u, err := s.oidc.AuthCodeURL(req.Request.Context(), state, nonce)
+	if err != nil {
+		log.Println("ERROR:", err)
+		resp.WriteHeaderAndEntity(502, &GeneralResponse{Success: false, Message: "identity provider unavailable"})
+		return
+	}
+	http.SetCookie(resp.ResponseWriter, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    nonce,
+		Path:     "/api/v1/oidc",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.conf.OIDC.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(resp.ResponseWriter, req.Request, u, http.StatusFound)
+}
+
+func (s *Server) GetOIDCCallback(req *restful.Request, resp *restful.Response) {
+	if e := req.QueryParameter("error"); e != "" {
+		resp.WriteHeaderAndEntity(401, &GeneralResponse{Success: false, Message: "login failed: " + e})
+		return
+	}
+	st, err := s.parseState(req.QueryParameter("state"))
+	if err != nil {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: err.Error()})
+		return
+	}
+	cookie, err := req.Request.Cookie(oidcCookie)
+	if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(st.Nonce)) {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "login started in another browser"})
+		return
+	}
+	http.SetCookie(resp.ResponseWriter, &http.Cookie{Name: oidcCookie, Path: "/api/v1/oidc", MaxAge: -1})
+	ctx := req.Request.Context()
+	raw, err := s.oidc.Exchange(ctx, req.QueryParameter("code"))
+	if err != nil {
+		log.Println("ERROR:", err)
+		resp.WriteHeaderAndEntity(401, &GeneralResponse{Success: false, Message: "login failed"})
+		return
+	}
+	claims, err := s.oidc.Verify(ctx, raw, st.Nonce)
+	if err != nil {
+		log.Println("ERROR:", err)
+		resp.WriteHeaderAndEntity(401, &GeneralResponse{Success: false, Message: "login failed"})
+		return
+	}
+	name, _ := claims[s.conf.OIDC.UsernameClaim].(string)
+	if name == "" {
+		resp.WriteHeaderAndEntity(403, &GeneralResponse{Success: false, Message: "no " + s.conf.OIDC.UsernameClaim + " claim"})
+		return
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		resp.WriteHeaderAndEntity(403, &GeneralResponse{Success: false, Message: "no sub claim"})
+		return
+	}
+	name, err = s.provisionUser(name, oidcSubject(s.conf.OIDC.Issuer, sub))
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	tok, secret, err := s.newSession(name)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	log.Println("user", name, "logged in, session", tok.Name)
+	if st.Redirect != "" {
+		// in the fragment, which browsers don't send anywhere
+		fragment := url.Values{
+			"token-name":   {tok.Name},
+			"token-secret": {secret},
+			"expires":      {tok.Expires.Format(time.RFC3339)},
+		}
+		http.Redirect(resp.ResponseWriter, req.Request, st.Redirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	resp.WriteEntity(&TokenSecretGet{Name: tok.Name, Secret: secret, Expires: tok.Expires})
+}
+
+// oidcSubject identifies an account at a provider, the user name claim may
+// change or be reused but the subject doesn't.
+func oidcSubject(issuer string, sub string) string {
+	return issuer + " " + sub
+}
+
+// provisionUser returns the user an account logs in as, creating it on its
+// first login with the configured role and starting balance. Users are found
+// by their subject, a name is only taken when nobody has it, or when an oidc
+// user from before subjects were kept has it.
+func (s *Server) provisionUser(name string, subject string) (string, error) {
+	err := retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			u := &models.User{Subject: subject}
+			ok, err := session.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				name = u.Name
+				return nil, nil
+			}
+			u = &models.User{Name: name}
+			ok, err = session.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				u.Role = s.conf.OIDC.Role
+				u.Source = oidcActor
+				u.Subject = subject
+				return nil, s.createUser(session, u, s.conf.OIDC.Balance, oidcActor)
+			}
+			if u.Source != oidcActor || u.Subject != "" {
+				return nil, newStatusError(403, "user "+name+" belongs to another account")
+			}
+			u.Subject = subject
+			return nil, update(session, u, name)
+		})
+		return err
+	})
+	return name, err
+}
+
+// createUser inserts a user made on its first login and credits its starting
+// balance through the ledger.
+func (s *Server) createUser(session *xorm.Session, u *models.User, balance map[string]int, actor string) error {
+	u.Balance = map[string]int{}
+	_, err := session.Insert(u)
+	if err != nil {
+		return err
+	}
+	log.Println("created user", u.Name, "on first login through", actor)
+	if len(balance) == 0 {
+		return nil
+	}
+	return s.postLedger(session, u, models.LedgerCredit, balance, "", actor, "starting balance")
+}
+
+// newSession gives out a session token, its secret is only known here.
+func (s *Server) newSession(user string) (*models.Token, string, error) {
+	id, err := models.NewSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := models.NewSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := models.HashSecret(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	tok := &models.Token{
+		Name:    "session-" + id[:16],
+		Secret:  hash,
+		User:    user,
+		Scopes:  s.conf.OIDC.TokenScopes,
+		Expires: time.Now().Add(s.conf.OIDC.SessionTTL),
+		Session: true,
+	}
+	_, err = s.orm.Insert(tok)
+	if err != nil {
+		return nil, "", err
+	}
+	return tok, secret, nil
+}
+
+// deleteExpiredSessions removes the session tokens that can't be used any
+// more, tokens made by users stay to be looked at.
+func (s *Server) deleteExpiredSessions() error {
+	_, err := s.orm.Where("session = ? AND expires < ?", true, time.Now()).Delete(&models.Token{})
+	return err
+}
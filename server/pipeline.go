@@ -0,0 +1,285 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"xorm.io/xorm"
+)
+
+// holdTask marks an inactive task held until the last activation of each task
+// in after has completed, which may be the case already. Nothing is charged
+// yet: the task is queued, and pays, once it is released.
+func (s *Server) holdTask(name string, after []string, lifetime time.Duration, preemptible bool, target int64, ifMatch string, actor string) error {
+	_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+		t := &models.Task{Name: name}
+		ok, err := session.Get(t)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTaskNotFound
+		}
+		if !matchETag(ifMatch, t.Version) {
+			return nil, errPreconditionFailed
+		}
+		if !models.TaskStates.CanTransit(t.Status, models.TaskHeld) {
+			return nil, errIllegalTransition(t.Status, models.TaskHeld)
+		}
+		for _, dep := range after {
+			d := &models.Task{Name: dep}
+			ok, err := session.Get(d)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || d.User != t.User {
+				return nil, newStatusError(200, "dependency "+dep+" not found")
+			}
+		}
+		cycle, err := s.dependencyCycle(session, name, after)
+		if err != nil {
+			return nil, err
+		}
+		if cycle != nil {
+			return nil, newStatusError(200, "dependency cycle: "+strings.Join(cycle, " -> "))
+		}
+		t.After = after
+		t.HeldLifeTime = lifetime
+		t.HeldTarget = target
+		t.Preemptible = preemptible
+		t.QueueTime = time.Now()
+		return nil, s.transitTask(session, t, models.TaskHeld, actor, "waiting for "+strings.Join(after, ", "))
+	})
+	return err
+}
+
+// dependencyCycle returns the path back to name if it waited for after, or nil.
+// Only held tasks wait, so only their dependencies are followed.
+func (s *Server) dependencyCycle(db xorm.Interface, name string, after []string) ([]string, error) {
+	visited := map[string]bool{}
+	var walk func(path []string, deps []string) ([]string, error)
+	walk = func(path []string, deps []string) ([]string, error) {
+		for _, dep := range deps {
+			if dep == name {
+				return append(path, dep), nil
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			d := &models.Task{Name: dep}
+			ok, err := db.Get(d)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || d.Status != models.TaskHeld {
+				continue
+			}
+			cycle, err := walk(append(path, dep), d.After)
+			if err != nil || cycle != nil {
+				return cycle, err
+			}
+		}
+		return nil, nil
+	}
+	return walk([]string{name}, after)
+}
+
+// dependencyDone reports whether the last activation of a dependency ran to
+// its end, whether before or after the task was held, and it is not running or
+// waiting to run again.
+func dependencyDone(dep *models.Task) bool {
+	return dep.Status == models.TaskInactive &&
+		!dep.Completed.IsZero() &&
+		!dep.Completed.Before(dep.ActiveTime)
+}
+
+// releaseHeld queues the held tasks whose dependencies are all done, and sends
+// back to inactive those that lost one or can't be queued.
+func (s *Server) releaseHeld() error {
+	tasks := []*models.Task{}
+	err := s.orm.Find(&tasks, &models.Task{Status: models.TaskHeld})
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		ready := true
+		gone := ""
+		for _, dep := range t.After {
+			d := &models.Task{Name: dep}
+			ok, err := s.orm.Get(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				gone = dep
+				break
+			}
+			if !dependencyDone(d) {
+				ready = false
+			}
+		}
+		if gone != "" {
+			err = s.unholdTask(t.Name, systemActor, "dependency "+gone+" is gone")
+			if err != nil {
+				log.Println("ERROR:", err)
+			}
+			continue
+		}
+		if !ready {
+			continue
+		}
+		err = s.queueHeld(t)
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+	return nil
+}
+
+// queueHeld charges a released task and puts it in the queue, the dispatcher
+// starts it from there.
+func (s *Server) queueHeld(held *models.Task) error {
+	var t *models.Task
+	err := retryOnConflict(func() error {
+		var err error
+		t, err = s.queueTask(held.Name, held.HeldLifeTime, held.Preemptible, etag(held.Version), systemActor)
+		return err
+	})
+	if err == errPreconditionFailed {
+		// cancelled or released in the meantime
+		return nil
+	}
+	if se, ok := err.(*statusError); ok && err != errConflict {
+		return s.unholdTask(held.Name, systemActor, "release failed: "+se.message)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("released task", t.Name)
+	_, err = s.orm.Insert(&models.Queue{
+		User:         t.User,
+		Task:         t.Name,
+		LifeTime:     held.HeldLifeTime,
+		InstanceType: t.InstanceType,
+		TargetID:     held.HeldTarget,
+		Count:        t.Size(),
+		Preemptible:  t.Preemptible,
+	})
+	return err
+}
+
+// unholdTask sends a held task back to inactive, it paid nothing yet.
+func (s *Server) unholdTask(name string, actor string, reason string) error {
+	return retryOnConflict(func() error {
+		t := &models.Task{Name: name}
+		ok, err := s.orm.Get(t)
+		if err != nil {
+			return err
+		}
+		if !ok || t.Status != models.TaskHeld {
+			return nil
+		}
+		return s.transitTask(s.orm, t, models.TaskInactive, actor, reason)
+	})
+}
+
+// pipeline returns the tasks of a user connected to a task through their
+// dependencies, upstream and downstream, dependencies first.
+func (s *Server) pipeline(t *models.Task) ([]*models.Task, error) {
+	tasks := []*models.Task{}
+	err := s.orm.Find(&tasks, &models.Task{User: t.User})
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*models.Task{}
+	dependents := map[string][]string{}
+	for _, task := range tasks {
+		byName[task.Name] = task
+		for _, dep := range task.After {
+			dependents[dep] = append(dependents[dep], task.Name)
+		}
+	}
+	// everything reachable from the task either way
+	connected := map[string]bool{t.Name: true}
+	pending := []string{t.Name}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		next := dependents[name]
+		if task, ok := byName[name]; ok {
+			next = append(append([]string{}, next...), task.After...)
+		}
+		for _, n := range next {
+			if _, ok := byName[n]; ok && !connected[n] {
+				connected[n] = true
+				pending = append(pending, n)
+			}
+		}
+	}
+	names := []string{}
+	for name := range connected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// dependencies first, stale dependencies may loop so stop at visited ones
+	rslt := []*models.Task{}
+	visited := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		task := byName[name]
+		for _, dep := range task.After {
+			if connected[dep] {
+				visit(dep)
+			}
+		}
+		rslt = append(rslt, task)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return rslt, nil
+}
+
+func pipelineGet(tasks []*models.Task) []*PipelineTaskGet {
+	rslt := []*PipelineTaskGet{}
+	for _, t := range tasks {
+		after := t.After
+		if after == nil {
+			after = []string{}
+		}
+		rslt = append(rslt, &PipelineTaskGet{
+			Name:      t.Name,
+			Status:    t.Status,
+			After:     after,
+			Completed: t.Completed,
+		})
+	}
+	return rslt
+}
+
+// checkAfter validates the dependency list of an activation request.
+func checkAfter(task string, after []string) error {
+	seen := map[string]bool{}
+	for _, dep := range after {
+		if dep == "" {
+			return newStatusError(200, "empty dependency")
+		}
+		if dep == task {
+			return newStatusError(200, "a task cannot run after itself")
+		}
+		if seen[dep] {
+			return newStatusError(200, fmt.Sprintf("dependency %v given twice", dep))
+		}
+		seen[dep] = true
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+func TestDependencyDone(t *testing.T) {
+	ran := func(status string, completed time.Duration) *models.Task {
+		d := &models.Task{Status: status, QueueTime: now.Add(-3 * time.Hour), ActiveTime: now.Add(-2 * time.Hour)}
+		if completed != 0 {
+			d.Completed = d.ActiveTime.Add(completed)
+		}
+		return d
+	}
+	cases := []struct {
+		name string
+		dep  *models.Task
+		done bool
+	}{
+		{"never ran", &models.Task{Status: models.TaskInactive}, false},
+		{"completed", ran(models.TaskInactive, time.Hour), true},
+		{"completed, then stopped", ran(models.TaskInactive, -time.Hour), false},
+		{"running again", ran(models.TaskActive, time.Hour), false},
+		{"queued again", ran(models.TaskQueued, time.Hour), false},
+		{"held itself", ran(models.TaskHeld, time.Hour), false},
+	}
+	for _, c := range cases {
+		if got := dependencyDone(c.dep); got != c.done {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.done)
+		}
+	}
+}
+
+// pipelineServer has alice with 100 CNY, the instance type x at 1 CNY a
+// minute on target 1, and her inactive tasks a to e.
+func pipelineServer(t *testing.T) *Server {
+	s, _ := newTestServer(t)
+	insert(t, s,
+		&models.User{Name: "alice", Balance: map[string]int{"CNY": 100}},
+		&models.InstanceType{Name: "x", Price: map[string]int{"CNY": 1}, SpotPrice: map[string]int{"CNY": 1}},
+		&models.InstanceTarget{Id: 1, Type: "x", Status: "idle"},
+	)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		insert(t, s, &models.Task{Name: name, InstanceType: "x", User: "alice", Status: models.TaskInactive})
+	}
+	return s
+}
+
+func TestHoldAgain(t *testing.T) {
+	s := pipelineServer(t)
+	err := s.holdTask("b", []string{"a", "c"}, time.Hour, true, 1, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.cancelTask("b", "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing pinned and not preemptible this time
+	err = s.holdTask("b", []string{"a"}, 30*time.Minute, false, 0, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := getTask(t, s, "b")
+	if b.Status != models.TaskHeld || !reflect.DeepEqual(b.After, []string{"a"}) ||
+		b.HeldLifeTime != 30*time.Minute || b.HeldTarget != 0 || b.Preemptible {
+		t.Errorf("held again as %+v", b)
+	}
+}
+
+func TestHoldErrors(t *testing.T) {
+	s := pipelineServer(t)
+	insert(t, s, &models.Task{Name: "bob's", InstanceType: "x", User: "bob", Status: models.TaskInactive})
+	if err := s.holdTask("b", []string{"a"}, time.Hour, false, 0, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		task  string
+		after []string
+		code  int
+	}{
+		{"missing dependency", "c", []string{"gone"}, 200},
+		{"other user's dependency", "c", []string{"bob's"}, 200},
+		{"cycle", "a", []string{"b"}, 200},
+		{"held already", "b", []string{"c"}, 409},
+		{"missing task", "gone", []string{"a"}, 404},
+	}
+	for _, c := range cases {
+		err := s.holdTask(c.task, c.after, time.Hour, false, 0, "", "alice")
+		if se, ok := err.(*statusError); !ok || se.status != c.code {
+			t.Errorf("%v: %v", c.name, err)
+		}
+	}
+}
+
+func TestReleaseHeld(t *testing.T) {
+	s := pipelineServer(t)
+	// a completed before anything was held
+	a := getTask(t, s, "a")
+	a.ActiveTime = now.Add(-2 * time.Hour)
+	a.Completed = now.Add(-time.Hour)
+	if err := update(s.orm, a, a.Name); err != nil {
+		t.Fatal(err)
+	}
+	for _, hold := range []struct {
+		task  string
+		after string
+	}{{"b", "a"}, {"c", "d"}, {"d", "e"}} {
+		if err := s.holdTask(hold.task, []string{hold.after}, time.Hour, false, 1, "", "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.orm.Delete(&models.Task{Name: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.releaseHeld()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"b": models.TaskQueued,   // a is done
+		"c": models.TaskHeld,     // d is held itself
+		"d": models.TaskInactive, // e is gone
+	} {
+		if got := getTask(t, s, name).Status; got != want {
+			t.Errorf("%v is %v, want %v", name, got, want)
+		}
+	}
+	queue := []*models.Queue{}
+	if err := s.orm.Find(&queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Task != "b" || queue[0].TargetID != 1 || queue[0].LifeTime != time.Hour || queue[0].Preemptible {
+		t.Errorf("queued %+v", queue)
+	}
+	if b := balance(t, s, "alice"); b["CNY"] != 40 {
+		t.Errorf("balance %v, want 40", b)
+	}
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/scheduler"
+)
+
+// queueEntries returns the queue of an instance type in submission order,
+// preemptible entries last, as scheduler entries, along with the rows they
+// came from by id.
+func (s *Server) queueEntries(instanceType string, now time.Time) ([]*scheduler.Entry, map[int64]*models.Queue, error) {
+	queue := []*models.Queue{}
+	err := s.orm.Where("instance_type = ?", instanceType).Asc("creation").Asc("id").Find(&queue)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows := map[int64]*models.Queue{}
+	entries := []*scheduler.Entry{}
+	users := map[string]*scheduler.Entry{}
+	for _, qi := range queue {
+		e := &scheduler.Entry{
+			ID:       qi.Id,
+			Task:     qi.Task,
+			User:     qi.User,
+			Creation: qi.Creation,
+			LifeTime: qi.LifeTime,
+			Count:    qi.Count,
+		}
+		e.Preemptible = qi.Preemptible
+		if qi.TargetID != 0 {
+			e.Targets = []int64{qi.TargetID}
+		}
+		if u, ok := users[qi.User]; ok {
+			e.Priority, e.Usage = u.Priority, u.Usage
+		} else {
+			err = s.fillEntry(e, now)
+			if err != nil {
+				return nil, nil, err
+			}
+			users[qi.User] = e
+		}
+		rows[qi.Id] = qi
+		entries = append(entries, e)
+	}
+	normalFirst(entries)
+	return entries, rows, nil
+}
+
+// normalFirst moves preemptible entries behind all others, they only get what
+// the others leave.
+func normalFirst(entries []*scheduler.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return !entries[i].Preemptible && entries[j].Preemptible
+	})
+}
+
+// fillEntry sets the priority of the user of an entry and, for policies that
+// read it, its usage.
+func (s *Server) fillEntry(e *scheduler.Entry, now time.Time) error {
+	var err error
+	e.Priority, err = s.userPriority(e.User)
+	if err != nil {
+		return err
+	}
+	if u, ok := s.sched.(scheduler.UsageAware); !ok || !u.UsesUsage() {
+		return nil
+	}
+	e.Usage, err = s.userUsage(e.User, now)
+	return err
+}
+
+// userPriority returns the static priority of a user, falling back to the one
+// of its role.
+func (s *Server) userPriority(user string) (int, error) {
+	conf := s.conf.Queue.Priorities
+	if p, ok := conf.Users[user]; ok {
+		return p, nil
+	}
+	if len(conf.Roles) == 0 {
+		return 0, nil
+	}
+	u := &models.User{Name: user}
+	ok, err := s.orm.Get(u)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return conf.Roles[u.Role], nil
+}
+
+// userUsage returns the decayed instance minutes a user consumed within the
+// fair-share window, including what its active tasks have used so far.
+func (s *Server) userUsage(user string, now time.Time) (float64, error) {
+	conf := s.conf.Queue.FairShare
+	since := now.Add(-conf.Window)
+	decayed := func(start time.Time, end time.Time) float64 {
+		if start.Before(since) {
+			start = since
+		}
+		if !end.After(start) {
+			return 0
+		}
+		age := now.Sub(end).Hours() / conf.HalfLife.Hours()
+		return end.Sub(start).Minutes() * math.Pow(0.5, age)
+	}
+	usages := []*models.Usage{}
+	err := s.orm.Where("end_time > ?", since).Find(&usages, &models.Usage{User: user})
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, u := range usages {
+		count := u.Count
+		if count < 1 {
+			count = 1
+		}
+		total += decayed(u.Start, u.End) * float64(count)
+	}
+	tasks := []*models.Task{}
+	err = s.orm.Find(&tasks, &models.Task{User: user, Status: models.TaskActive})
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tasks {
+		total += decayed(t.ActiveTime, now) * float64(t.Size())
+	}
+	return total, nil
+}
+
+// schedulerTargets returns the targets of an instance type in id order, busy
+// ones free at the end time of their task, with their reservations.
+func (s *Server) schedulerTargets(instanceType string, now time.Time) ([]*scheduler.Target, error) {
+	targets := []*models.InstanceTarget{}
+	err := s.orm.Asc("id").Find(&targets, &models.InstanceTarget{Type: instanceType})
+	if err != nil {
+		return nil, err
+	}
+	windows, err := s.reservationWindows(instanceType, now)
+	if err != nil {
+		return nil, err
+	}
+	rslt := []*scheduler.Target{}
+	for _, target := range targets {
+		st := &scheduler.Target{ID: target.Id, FreeAt: now, Reservations: windows[target.Id]}
+		if target.Target != nil {
+			st.Node = target.Target.Target
+		}
+		if target.Status != "idle" {
+			// expiry is about to free targets whose task is over
+			st.FreeAt = now.Add(time.Second)
+			if target.Task != "" {
+				t := &models.Task{Name: target.Task}
+				ok, err := s.orm.Get(t)
+				if err != nil {
+					return nil, err
+				}
+				if ok && t.Status == models.TaskActive && t.EndTime.After(st.FreeAt) {
+					st.FreeAt = t.EndTime
+				}
+			}
+		}
+		rslt = append(rslt, st)
+	}
+	return rslt, nil
+}
+
+// extensionStarves reports whether moving the end of an active task to
+// endTime delays the entry the configured policy would start next, so that it
+// waits longer than limit since it was queued.
+func (s *Server) extensionStarves(t *models.Task, endTime time.Time, limit time.Duration) (bool, error) {
+	now := time.Now()
+	entries, _, err := s.queueEntries(t.InstanceType, now)
+	if err != nil {
+		return false, err
+	}
+	entries, err = s.withinQuota(t.InstanceType, entries)
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+	targets, err := s.schedulerTargets(t.InstanceType, now)
+	if err != nil {
+		return false, err
+	}
+	before := scheduler.Forecast(s.sched, entries, targets, now)
+	var head *scheduler.Entry
+	for _, e := range entries {
+		if start, ok := before[e]; ok && (head == nil || start.Before(before[head])) {
+			head = e
+		}
+	}
+	if head == nil {
+		// nothing queued would start anyway
+		return false, nil
+	}
+	mine := map[int64]bool{}
+	for _, id := range t.AllTargets() {
+		mine[id] = true
+	}
+	extended := make([]*scheduler.Target, len(targets))
+	for i, target := range targets {
+		c := *target
+		if mine[c.ID] && endTime.After(c.FreeAt) {
+			c.FreeAt = endTime
+		}
+		extended[i] = &c
+	}
+	start, ok := scheduler.Forecast(s.sched, entries, extended, now)[head]
+	if !ok {
+		return true, nil
+	}
+	return start.After(before[head]) && start.Sub(head.Creation) > limit, nil
+}
+
+// scheduleTargets asks the scheduler for the targets to start a task on right
+// away, behind the current queue of its type. It returns nil when the task
+// would have to wait. pin restricts the task to one target when not 0.
+func (s *Server) scheduleTargets(task *models.Task, lifetime time.Duration, pin int64) ([]*models.InstanceTarget, error) {
+	now := time.Now()
+	entries, _, err := s.queueEntries(task.InstanceType, now)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.schedulerTargets(task.InstanceType, now)
+	if err != nil {
+		return nil, err
+	}
+	e := &scheduler.Entry{Task: task.Name, User: task.User, Creation: now, LifeTime: lifetime, Count: task.Size(), Preemptible: task.Preemptible}
+	if pin != 0 {
+		e.Targets = []int64{pin}
+	}
+	err = s.fillEntry(e, now)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, e)
+	normalFirst(entries)
+	entries, err = s.withinQuota(task.InstanceType, entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range s.sched.Schedule(entries, targets, now) {
+		if a.Entry == e {
+			return instanceTargets(a), nil
+		}
+	}
+	return nil, nil
+}
+
+// startTask activates a queued task right away when the scheduler lets it,
+// false means it has to wait in the queue.
+func (s *Server) startTask(task *models.Task, lifetime time.Duration, pin int64, actor string) (bool, error) {
+	started := false
+	err := retryOnConflict(func() error {
+		targets, err := s.scheduleTargets(task, lifetime, pin)
+		if err != nil || targets == nil {
+			return err
+		}
+		started, err = s.activateTask(task, lifetime, targets, actor)
+		if err == nil && !started {
+			// another process took a target, schedule again
+			return errConflict
+		}
+		return err
+	})
+	if err == errConflict {
+		return false, nil
+	}
+	return started, err
+}
+
+// placeTask picks the targets the instances of a new task are created on: the
+// ones the scheduler would start it on now or, when none fit, as if all were
+// free. It returns nil when the instance type has too few targets.
+func (s *Server) placeTask(task *models.Task) ([]*models.InstanceTarget, error) {
+	now := time.Now()
+	targets, err := s.schedulerTargets(task.InstanceType, now)
+	if err != nil {
+		return nil, err
+	}
+	e := &scheduler.Entry{Task: task.Name, User: task.User, Creation: now, Count: task.Size()}
+	err = s.fillEntry(e, now)
+	if err != nil {
+		return nil, err
+	}
+	assigned := s.sched.Schedule([]*scheduler.Entry{e}, targets, now)
+	if len(assigned) == 0 {
+		for _, t := range targets {
+			t.FreeAt = now
+			t.Reservations = nil
+		}
+		assigned = s.sched.Schedule([]*scheduler.Entry{e}, targets, now)
+	}
+	if len(assigned) == 0 {
+		return nil, nil
+	}
+	rslt := instanceTargets(assigned[0])
+	for _, target := range rslt {
+		_, err = s.orm.Get(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rslt, nil
+}
+
+func instanceTargets(a *scheduler.Assignment) []*models.InstanceTarget {
+	rslt := []*models.InstanceTarget{}
+	for _, t := range a.Targets {
+		rslt = append(rslt, &models.InstanceTarget{Id: t.ID})
+	}
+	return rslt
+}
+
+// estimateQueueTime estimates how long a task submitted now would wait, when
+// only the entries queued before creationBefore are ahead of it.
+func (s *Server) estimateQueueTime(instanceType string, creationBefore time.Time) (time.Duration, error) {
+	now := time.Now()
+	queue, _, err := s.queueEntries(instanceType, now)
+	if err != nil {
+		return 0, err
+	}
+	entries := []*scheduler.Entry{}
+	for _, e := range queue {
+		if e.Creation.Before(creationBefore) {
+			entries = append(entries, e)
+		}
+	}
+	e := &scheduler.Entry{Creation: now}
+	entries = append(entries, e)
+	targets, err := s.schedulerTargets(instanceType, now)
+	if err != nil {
+		return 0, err
+	}
+	starts := scheduler.Forecast(s.sched, entries, targets, now)
+	if starts == nil {
+		return 0, errNoTargets
+	}
+	start, ok := starts[e]
+	if !ok {
+		return 0, errNeverStarts
+	}
+	return start.Sub(now), nil
+}
+
+// taskQueuePosition returns the 1-based position of a queued task, by
+// projected start, and the projected start.
+func (s *Server) taskQueuePosition(task *models.Task) (int, time.Time, error) {
+	now := time.Now()
+	entries, _, err := s.queueEntries(task.InstanceType, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var entry *scheduler.Entry
+	for _, e := range entries {
+		if e.Task == task.Name {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		return 0, time.Time{}, errNotInQueue
+	}
+	targets, err := s.schedulerTargets(task.InstanceType, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	starts := scheduler.Forecast(s.sched, entries, targets, now)
+	if starts == nil {
+		return 0, time.Time{}, errNoTargets
+	}
+	start, ok := starts[entry]
+	if !ok {
+		return 0, time.Time{}, errNeverStarts
+	}
+	pos := 1
+	for _, e := range entries {
+		if e == entry {
+			continue
+		}
+		if other, ok := starts[e]; ok && (other.Before(start) || other.Equal(start) && e.Creation.Before(entry.Creation)) {
+			pos++
+		}
+	}
+	return pos, start, nil
+}
+
+// preempt stops the youngest preemptible tasks of an instance type, as few as
+// the scheduler needs to start a queued normal entry on their targets. It
+// reports whether it stopped any.
+func (s *Server) preempt(instanceType string, entries []*scheduler.Entry, targets []*scheduler.Target, now time.Time) (bool, error) {
+	normal := []*scheduler.Entry{}
+	for _, e := range entries {
+		if !e.Preemptible {
+			normal = append(normal, e)
+		}
+	}
+	if len(normal) == 0 {
+		return false, nil
+	}
+	victims := []*models.Task{}
+	err := s.orm.Where("preemptible = ?", true).Desc("active_time").Find(&victims, &models.Task{InstanceType: instanceType, Status: models.TaskActive})
+	if err != nil {
+		return false, err
+	}
+	freed := map[int64]*models.Task{}
+	for _, victim := range victims {
+		for _, id := range victim.AllTargets() {
+			freed[id] = victim
+		}
+		whatIf := []*scheduler.Target{}
+		for _, t := range targets {
+			c := *t
+			if freed[t.ID] != nil {
+				c.FreeAt = now
+			}
+			whatIf = append(whatIf, &c)
+		}
+		used := map[*models.Task]bool{}
+		for _, a := range s.sched.Schedule(normal, whatIf, now) {
+			for _, t := range a.Targets {
+				if v := freed[t.ID]; v != nil {
+					used[v] = true
+				}
+			}
+		}
+		if len(used) == 0 {
+			continue
+		}
+		for v := range used {
+			log.Println("preempting task", v.Name)
+			// dispatchQueue, the only caller, starts the queued entry on its next pass
+			err = s.stopTask(v, systemActor, "preempted by a queued task")
+			if err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
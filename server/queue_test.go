@@ -0,0 +1,93 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+func TestPreempt(t *testing.T) {
+	cases := []struct {
+		name        string
+		running     []*models.Task // on targets 1 and 2
+		preemptible bool           // the queued entry
+		preempted   bool
+		stopped     []string
+	}{
+		{
+			"only preemptible tasks are stopped",
+			[]*models.Task{running("spot", 1, time.Hour, true), running("paid", 2, time.Minute, false)},
+			false, true, []string{"spot"},
+		},
+		{
+			"the youngest preemptible task goes first",
+			[]*models.Task{running("old", 1, time.Hour, true), running("young", 2, time.Minute, true)},
+			false, true, []string{"young"},
+		},
+		{
+			"normal tasks are never stopped",
+			[]*models.Task{running("paid", 1, time.Hour, false), running("other", 2, time.Minute, false)},
+			false, false, nil,
+		},
+		{
+			"preemptible entries don't preempt",
+			[]*models.Task{running("spot", 1, time.Hour, true), running("paid", 2, time.Minute, false)},
+			true, false, nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, fake := newTestServer(t)
+			insert(t, s, &models.User{Name: "alice", Balance: map[string]int{"CNY": 0}})
+			for i, task := range c.running {
+				insert(t, s, task, &models.InstanceTarget{
+					Id:       int64(i + 1),
+					Type:     "x",
+					Status:   "busy",
+					Task:     task.Name,
+					Instance: task.Instance,
+				})
+			}
+			insert(t, s, &models.Queue{
+				User:         "bob",
+				Task:         "job",
+				InstanceType: "x",
+				LifeTime:     time.Hour,
+				Count:        1,
+				Preemptible:  c.preemptible,
+			})
+			entries, _, err := s.queueEntries("x", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targets, err := s.schedulerTargets("x", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			preempted, err := s.preempt("x", entries, targets, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preempted != c.preempted {
+				t.Errorf("preempted %v, want %v", preempted, c.preempted)
+			}
+			var stopped []string
+			for _, task := range c.running {
+				got := getTask(t, s, task.Name)
+				if got.Status == models.TaskInactive {
+					stopped = append(stopped, task.Name)
+					if len(fake.stopped) != 1 || fake.stopped[0] != task.Instance {
+						t.Errorf("instances stopped: %v", fake.stopped)
+					}
+				} else if got.Status != models.TaskActive {
+					t.Errorf("%v is %v", task.Name, got.Status)
+				}
+			}
+			if !reflect.DeepEqual(stopped, c.stopped) {
+				t.Errorf("stopped %v, want %v", stopped, c.stopped)
+			}
+		})
+	}
+}
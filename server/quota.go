@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/scheduler"
+	"github.com/lcpu-dev/vmsched/utils/config"
+	"xorm.io/xorm"
+)
+
+// quotaOf returns the quota of a user across all instance types.
+func (s *Server) quotaOf(u *models.User) config.Quota {
+	conf := s.conf.Quota
+	return conf.Default.Merge(conf.Roles[u.Role]).Merge(conf.Users[u.Name])
+}
+
+// typeQuota returns the quota every user has within an instance type.
+func (s *Server) typeQuota(instanceType string) config.Quota {
+	return config.Quota{}.Merge(s.conf.Quota.Types[instanceType])
+}
+
+// quotaUsage counts the active and queued tasks and the instances of a user,
+// within an instance type unless it is empty.
+func (s *Server) quotaUsage(db xorm.Interface, user string, instanceType string) (active int, queued int, instances int, err error) {
+	tasks := []*models.Task{}
+	err = db.Find(&tasks, &models.Task{User: user, InstanceType: instanceType})
+	if err != nil {
+		return
+	}
+	for _, t := range tasks {
+		switch t.Status {
+		case models.TaskActive:
+			active++
+		case models.TaskQueued:
+			queued++
+		}
+		instances += t.Size()
+	}
+	return
+}
+
+func errQuota(format string, a ...interface{}) error {
+	return newStatusError(200, "quota exceeded: "+fmt.Sprintf(format, a...))
+}
+
+// checkInstanceQuota refuses creating a task of count instances.
+func (s *Server) checkInstanceQuota(u *models.User, instanceType string, count int) error {
+	for _, c := range []struct {
+		quota config.Quota
+		typ   string
+	}{{s.quotaOf(u), ""}, {s.typeQuota(instanceType), instanceType}} {
+		if c.quota.MaxInstances <= 0 {
+			continue
+		}
+		_, _, instances, err := s.quotaUsage(s.orm, u.Name, c.typ)
+		if err != nil {
+			return err
+		}
+		if instances+count > c.quota.MaxInstances {
+			return errQuota("at most %v instances%v, %v in use", c.quota.MaxInstances, inType(c.typ), instances)
+		}
+	}
+	return nil
+}
+
+// checkActivationQuota refuses activating an inactive task for lifetime. Run
+// it in the transaction that queues the task.
+func (s *Server) checkActivationQuota(db xorm.Interface, u *models.User, t *models.Task, lifetime time.Duration) error {
+	for _, c := range []struct {
+		quota config.Quota
+		typ   string
+	}{{s.quotaOf(u), ""}, {s.typeQuota(t.InstanceType), t.InstanceType}} {
+		if c.quota.MaxLifeTime > 0 && lifetime > c.quota.MaxLifeTime {
+			return errQuota("lifetime is at most %v%v", c.quota.MaxLifeTime, inType(c.typ))
+		}
+		if c.quota.MaxActive <= 0 && c.quota.MaxQueued <= 0 {
+			continue
+		}
+		active, queued, _, err := s.quotaUsage(db, u.Name, c.typ)
+		if err != nil {
+			return err
+		}
+		if c.quota.MaxActive > 0 && active >= c.quota.MaxActive {
+			return errQuota("at most %v active tasks%v", c.quota.MaxActive, inType(c.typ))
+		}
+		if c.quota.MaxQueued > 0 && queued >= c.quota.MaxQueued {
+			return errQuota("at most %v queued tasks%v", c.quota.MaxQueued, inType(c.typ))
+		}
+	}
+	return nil
+}
+
+// checkExtensionQuota refuses extending an active task past the longest
+// lifetime allowed for one activation.
+func (s *Server) checkExtensionQuota(db xorm.Interface, t *models.Task, extra time.Duration) error {
+	u := &models.User{Name: t.User}
+	ok, err := db.Get(u)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUserNotFound
+	}
+	for _, c := range []struct {
+		quota config.Quota
+		typ   string
+	}{{s.quotaOf(u), ""}, {s.typeQuota(t.InstanceType), t.InstanceType}} {
+		if c.quota.MaxLifeTime > 0 && t.LifeTime+extra > c.quota.MaxLifeTime {
+			return errQuota("lifetime is at most %v%v", c.quota.MaxLifeTime, inType(c.typ))
+		}
+	}
+	return nil
+}
+
+// withinQuota drops the entries that would take their user past its active
+// task quota if they all started, counting from the head of the queue. The
+// dropped entries stay queued, those of users that don't exist are kept.
+func (s *Server) withinQuota(instanceType string, entries []*scheduler.Entry) ([]*scheduler.Entry, error) {
+	typeQuota := s.typeQuota(instanceType)
+	type room struct{ all, typ int }
+	rooms := map[string]*room{}
+	rslt := []*scheduler.Entry{}
+	for _, e := range entries {
+		r, ok := rooms[e.User]
+		if !ok {
+			u := &models.User{Name: e.User}
+			found, err := s.orm.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			r = &room{all: -1, typ: -1}
+			if !found {
+				// no quota to count it against, it is left to the scheduler
+				log.Println("queued task", e.Task, "has unknown user", e.User)
+				rooms[e.User] = r
+				rslt = append(rslt, e)
+				continue
+			}
+			if q := s.quotaOf(u); q.MaxActive > 0 {
+				active, _, _, err := s.quotaUsage(s.orm, u.Name, "")
+				if err != nil {
+					return nil, err
+				}
+				r.all = left(q.MaxActive, active)
+			}
+			if typeQuota.MaxActive > 0 {
+				active, _, _, err := s.quotaUsage(s.orm, u.Name, instanceType)
+				if err != nil {
+					return nil, err
+				}
+				r.typ = left(typeQuota.MaxActive, active)
+			}
+			rooms[e.User] = r
+		}
+		if r.all == 0 || r.typ == 0 {
+			continue
+		}
+		if r.all > 0 {
+			r.all--
+		}
+		if r.typ > 0 {
+			r.typ--
+		}
+		rslt = append(rslt, e)
+	}
+	return rslt, nil
+}
+
+func left(limit int, used int) int {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// quotaGet shows a quota along with what a user uses of it.
+func (s *Server) quotaGet(q config.Quota, user string, instanceType string) (*QuotaGet, error) {
+	active, queued, instances, err := s.quotaUsage(s.orm, user, instanceType)
+	if err != nil {
+		return nil, err
+	}
+	rslt := &QuotaGet{
+		MaxActive:    q.MaxActive,
+		MaxQueued:    q.MaxQueued,
+		MaxInstances: q.MaxInstances,
+		Active:       active,
+		Queued:       queued,
+		Instances:    instances,
+	}
+	if q.MaxLifeTime > 0 {
+		rslt.MaxLifeTime = q.MaxLifeTime.String()
+	}
+	return rslt, nil
+}
+
+func inType(instanceType string) string {
+	if instanceType == "" {
+		return ""
+	}
+	return " of type " + instanceType
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/utils/config"
+)
+
+func TestActivationQuota(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := &models.User{Name: "alice", Role: "user"}
+	insert(t, s, alice,
+		&models.Task{Name: "running", InstanceType: "x", User: "alice", Status: models.TaskActive, Count: 2},
+		&models.Task{Name: "waiting", InstanceType: "y", User: "alice", Status: models.TaskQueued},
+		&models.Task{Name: "bob's", InstanceType: "x", User: "bob", Status: models.TaskActive},
+	)
+	cases := []struct {
+		name     string
+		quota    config.QuotaConfigure
+		typ      string
+		lifetime time.Duration
+		ok       bool
+	}{
+		{"no limits", config.QuotaConfigure{}, "x", time.Hour, true},
+		{"active tasks", config.QuotaConfigure{Default: &config.Quota{MaxActive: 1}}, "x", time.Hour, false},
+		{"role over default", config.QuotaConfigure{
+			Default: &config.Quota{MaxActive: 1},
+			Roles:   map[string]*config.Quota{"user": {MaxActive: 2}},
+		}, "x", time.Hour, true},
+		{"user over role", config.QuotaConfigure{
+			Roles: map[string]*config.Quota{"user": {MaxActive: 2}},
+			Users: map[string]*config.Quota{"alice": {MaxActive: 1}},
+		}, "x", time.Hour, false},
+		{"queued tasks", config.QuotaConfigure{Default: &config.Quota{MaxQueued: 1}}, "x", time.Hour, false},
+		{"lifetime", config.QuotaConfigure{Default: &config.Quota{MaxLifeTime: 30 * time.Minute}}, "x", time.Hour, false},
+		{"lifetime within", config.QuotaConfigure{Default: &config.Quota{MaxLifeTime: time.Hour}}, "x", time.Hour, true},
+		{"active tasks of the type", config.QuotaConfigure{Types: map[string]*config.Quota{"x": {MaxActive: 1}}}, "x", time.Hour, false},
+		{"active tasks of another type", config.QuotaConfigure{Types: map[string]*config.Quota{"x": {MaxActive: 1}}}, "y", time.Hour, true},
+		{"lifetime of the type", config.QuotaConfigure{Types: map[string]*config.Quota{"y": {MaxLifeTime: time.Minute}}}, "y", time.Hour, false},
+	}
+	for _, c := range cases {
+		s.conf.Quota = &c.quota
+		if s.conf.Quota.Default == nil {
+			s.conf.Quota.Default = &config.Quota{}
+		}
+		err := s.checkActivationQuota(s.orm, alice, &models.Task{Name: "new", InstanceType: c.typ, User: "alice"}, c.lifetime)
+		if c.ok && err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%v: not refused", c.name)
+		}
+	}
+}
+
+func TestInstanceQuota(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := &models.User{Name: "alice", Role: "user"}
+	insert(t, s, alice,
+		&models.Task{Name: "group", InstanceType: "x", User: "alice", Status: models.TaskInactive, Count: 3},
+		&models.Task{Name: "single", InstanceType: "y", User: "alice", Status: models.TaskActive},
+	)
+	cases := []struct {
+		name  string
+		quota config.QuotaConfigure
+		typ   string
+		count int
+		ok    bool
+	}{
+		{"within", config.QuotaConfigure{Default: &config.Quota{MaxInstances: 6}}, "x", 2, true},
+		{"groups count every instance", config.QuotaConfigure{Default: &config.Quota{MaxInstances: 6}}, "x", 3, false},
+		{"within the type", config.QuotaConfigure{Types: map[string]*config.Quota{"y": {MaxInstances: 2}}}, "y", 1, true},
+		{"beyond the type", config.QuotaConfigure{Types: map[string]*config.Quota{"x": {MaxInstances: 4}}}, "x", 2, false},
+	}
+	for _, c := range cases {
+		s.conf.Quota = &c.quota
+		if s.conf.Quota.Default == nil {
+			s.conf.Quota.Default = &config.Quota{}
+		}
+		err := s.checkInstanceQuota(alice, c.typ, c.count)
+		if c.ok && err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%v: not refused", c.name)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// reconcile repairs the state a process leaves behind when it dies inside
+// PostUserTask, killTask or DeleteTask, by comparing Task, InstanceTarget and
+// Queue rows with the instances LXD actually has.
+func (s *Server) reconcile() error {
+	tasks := []*models.Task{}
+	err := s.orm.Find(&tasks)
+	if err != nil {
+		return err
+	}
+	stale := time.Now().Add(-s.conf.Reconcile.Grace)
+	for _, task := range tasks {
+		if task.Status != models.TaskActive && task.Updated.After(stale) {
+			continue
+		}
+		err = s.reconcileTask(task)
+		if err != nil {
+			log.Println("ERROR: reconcile task", task.Name+":", err)
+		}
+	}
+	err = s.reconcileTargets()
+	if err != nil {
+		return err
+	}
+	return s.reconcileQueue()
+}
+
+func (s *Server) reconcileTask(task *models.Task) error {
+	switch task.Status {
+	case models.TaskCreating:
+		missing, err := s.missingInstances(task)
+		if err != nil {
+			return err
+		}
+		if missing > 0 {
+			log.Println("reconcile: task", task.Name, "was never fully created, removing it")
+			for _, instance := range task.AllInstances() {
+				err = s.deleteInstance(instance)
+				if err != nil {
+					return err
+				}
+			}
+			return s.transitTask(s.orm, task, models.TaskDeleted, systemActor, "reconcile: instance was never created")
+		}
+		log.Println("reconcile: task", task.Name, "finished creating, marking it inactive")
+		return s.transitTask(s.orm, task, models.TaskInactive, systemActor, "reconcile: instance exists")
+	case models.TaskTerminating:
+		log.Println("reconcile: finishing termination of task", task.Name)
+		for _, instance := range task.AllInstances() {
+			err := s.stopInstance(instance)
+			if err != nil && !api.StatusErrorCheck(err, http.StatusNotFound) {
+				return err
+			}
+		}
+		return s.finishKill(task, systemActor)
+	case models.TaskDeleting:
+		log.Println("reconcile: retrying deletion of task", task.Name)
+		for _, instance := range task.AllInstances() {
+			err := s.deleteInstance(instance)
+			if err != nil {
+				return err
+			}
+		}
+		return s.transitTask(s.orm, task, models.TaskDeleted, systemActor, "reconcile: instance deleted")
+	case models.TaskQueued:
+		ok, err := s.orm.Exist(&models.Queue{Task: task.Name})
+		if err != nil || ok {
+			return err
+		}
+		log.Println("reconcile: task", task.Name, "is queued without a queue entry, marking it inactive and refunding it")
+		err = s.deactivateTask(task, systemActor, "reconcile: queued without a queue entry")
+		if err != nil {
+			return err
+		}
+		return s.releaseTargetsOf(task.Name)
+	case models.TaskActive:
+		missing, err := s.missingInstances(task)
+		if err != nil {
+			return err
+		}
+		if missing > 0 {
+			// a group can't run with part of its instances, stop the rest
+			log.Println("reconcile: instance of active task", task.Name, "is gone, marking it inactive")
+			err = s.transitTask(s.orm, task, models.TaskTerminating, systemActor, "reconcile: instance is gone")
+			if err != nil {
+				return err
+			}
+			err = s.stopInstances(task)
+			if err != nil && !api.StatusErrorCheck(err, http.StatusNotFound) {
+				return err
+			}
+			return s.finishKill(task, systemActor)
+		}
+		instances := task.AllInstances()
+		for i, id := range task.AllTargets() {
+			target := &models.InstanceTarget{Id: id}
+			ok, err := s.orm.Get(target)
+			if err != nil {
+				return err
+			}
+			if !ok || (target.Status == "busy" && target.Task == task.Name) {
+				continue
+			}
+			log.Println("reconcile: target", target.Id, "runs active task", task.Name, "but is not marked so")
+			target.Status = "busy"
+			target.Task = task.Name
+			if i < len(instances) {
+				target.Instance = instances[i]
+			}
+			err = update(s.orm, target, target.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileTargets frees busy targets that no active task runs on.
+func (s *Server) reconcileTargets() error {
+	targets := []*models.InstanceTarget{}
+	err := s.orm.Find(&targets, &models.InstanceTarget{Status: "busy"})
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		task := &models.Task{Name: target.Task}
+		ok := false
+		if target.Task != "" {
+			ok, err = s.orm.Get(task)
+			if err != nil {
+				return err
+			}
+		}
+		if ok {
+			switch task.Status {
+			case models.TaskActive, models.TaskTerminating:
+				if holds(task.AllTargets(), target.Id) {
+					continue
+				}
+			case models.TaskQueued:
+				// activation in progress, or handled by reconcileTask
+				continue
+			}
+		}
+		log.Println("reconcile: freeing target", target.Id, "held by task", target.Task)
+		err = s.releaseTarget(target.Id, target.Task)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileQueue drops queue entries whose task is no longer queued.
+func (s *Server) reconcileQueue() error {
+	queue := []*models.Queue{}
+	err := s.orm.Find(&queue)
+	if err != nil {
+		return err
+	}
+	for _, qi := range queue {
+		task := &models.Task{Name: qi.Task}
+		ok, err := s.orm.Get(task)
+		if err != nil {
+			return err
+		}
+		if ok && task.Status == models.TaskQueued {
+			continue
+		}
+		log.Println("reconcile: dropping queue entry", qi.Id, "of task", qi.Task)
+		_, err = s.orm.Delete(&models.Queue{Id: qi.Id})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) releaseTargetsOf(task string) error {
+	targets := []*models.InstanceTarget{}
+	err := s.orm.Find(&targets, &models.InstanceTarget{Task: task, Status: "busy"})
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		log.Println("reconcile: freeing target", target.Id, "held by task", task)
+		err = s.releaseTarget(target.Id, task)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingInstances counts the instances of a task LXD doesn't have.
+func (s *Server) missingInstances(task *models.Task) (int, error) {
+	missing := 0
+	for _, instance := range task.AllInstances() {
+		status, err := s.instanceStatus(instance)
+		if err != nil {
+			return 0, err
+		}
+		if status == "" {
+			missing++
+		}
+	}
+	return missing, nil
+}
+
+func holds(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceStatus returns the LXD status of an instance, or an empty string if
+// it doesn't exist.
+func (s *Server) instanceStatus(instance string) (string, error) {
+	state, _, err := s.lxd.GetInstanceState(instance)
+	if err != nil {
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return state.Status, nil
+}
+
+// deleteInstance deletes an instance, treating a missing one as deleted.
+func (s *Server) deleteInstance(instance string) error {
+	op, err := s.lxd.DeleteInstance(instance)
+	if err != nil {
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	return op.Wait()
+}
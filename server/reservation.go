@@ -0,0 +1,169 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/scheduler"
+	"xorm.io/xorm"
+)
+
+var errNotEnoughTargets = newStatusError(200, "not enough targets are free for the window")
+
+// overlappingReservations returns the reservations of an instance type whose
+// window overlaps [from, to).
+func (s *Server) overlappingReservations(db xorm.Interface, instanceType string, from time.Time, to time.Time) ([]*models.Reservation, error) {
+	rslt := []*models.Reservation{}
+	err := db.Where("instance_type = ? AND start_time < ? AND end_time > ?", instanceType, to, from).Find(&rslt)
+	if err != nil {
+		return nil, err
+	}
+	return rslt, nil
+}
+
+// reservationWindows returns the reservations of an instance type not over
+// yet, by target, as the scheduler sees them.
+func (s *Server) reservationWindows(instanceType string, now time.Time) (map[int64][]*scheduler.Reservation, error) {
+	reservations := []*models.Reservation{}
+	err := s.orm.Where("instance_type = ? AND end_time > ?", instanceType, now).Find(&reservations)
+	if err != nil {
+		return nil, err
+	}
+	rslt := map[int64][]*scheduler.Reservation{}
+	for _, r := range reservations {
+		w := &scheduler.Reservation{Start: r.Start, End: r.End, Users: r.Users}
+		for _, id := range r.Targets {
+			rslt[id] = append(rslt[id], w)
+		}
+	}
+	return rslt, nil
+}
+
+// createReservation picks targets for a reservation among those no other
+// reservation holds during its window and no running task holds past its
+// start, and stores it.
+func (s *Server) createReservation(r *models.Reservation) error {
+	_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+		ok, err := session.Exist(&models.InstanceType{Name: r.InstanceType})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTypeNotFound
+		}
+		others, err := s.overlappingReservations(session, r.InstanceType, r.Start, r.End)
+		if err != nil {
+			return nil, err
+		}
+		taken := map[int64]bool{}
+		for _, o := range others {
+			for _, id := range o.Targets {
+				taken[id] = true
+			}
+		}
+		targets := []*models.InstanceTarget{}
+		err = session.Asc("id").Find(&targets, &models.InstanceTarget{Type: r.InstanceType})
+		if err != nil {
+			return nil, err
+		}
+		r.Targets = []int64{}
+		for _, target := range targets {
+			if len(r.Targets) == r.Count {
+				break
+			}
+			if taken[target.Id] {
+				continue
+			}
+			if target.Status != "idle" {
+				t := &models.Task{Name: target.Task}
+				ok, err := session.Get(t)
+				if err != nil {
+					return nil, err
+				}
+				if ok && (t.Status != models.TaskActive || t.EndTime.After(r.Start)) {
+					continue
+				}
+			}
+			r.Targets = append(r.Targets, target.Id)
+		}
+		if len(r.Targets) < r.Count {
+			return nil, errNotEnoughTargets
+		}
+		_, err = session.Insert(r)
+		return nil, err
+	})
+	return err
+}
+
+// reservedAgainst reports whether a target is reserved for others than user
+// at some point in [from, to).
+func (s *Server) reservedAgainst(db xorm.Interface, target *models.InstanceTarget, user string, from time.Time, to time.Time) (bool, error) {
+	reservations, err := s.overlappingReservations(db, target.Type, from, to)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range reservations {
+		w := &scheduler.Reservation{Users: r.Users}
+		for _, id := range r.Targets {
+			if id == target.Id && !w.Admits(user) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// releaseReservations gives back the targets of started reservations that
+// none of their users took within the configured delay.
+func (s *Server) releaseReservations() error {
+	after := s.conf.Reservation.ReleaseAfter
+	if after <= 0 {
+		return nil
+	}
+	now := time.Now()
+	reservations := []*models.Reservation{}
+	err := s.orm.Where("released = ? AND start_time <= ? AND end_time > ?", false, now.Add(-after), now).Find(&reservations)
+	if err != nil {
+		return err
+	}
+	for _, found := range reservations {
+		err = retryOnConflict(func() error {
+			r := &models.Reservation{Id: found.Id}
+			ok, err := s.orm.Get(r)
+			if err != nil || !ok || r.Released {
+				return err
+			}
+			w := &scheduler.Reservation{Users: r.Users}
+			kept := []int64{}
+			for _, id := range r.Targets {
+				target := &models.InstanceTarget{Id: id}
+				ok, err := s.orm.Get(target)
+				if err != nil {
+					return err
+				}
+				if !ok || target.Status == "idle" {
+					continue
+				}
+				t := &models.Task{Name: target.Task}
+				ok, err = s.orm.Get(t)
+				if err != nil {
+					return err
+				}
+				if ok && w.Admits(t.User) {
+					kept = append(kept, id)
+				}
+			}
+			if len(kept) < len(r.Targets) {
+				log.Println("reservation", r.Id, "releases", len(r.Targets)-len(kept), "unused targets")
+			}
+			r.Targets = kept
+			r.Released = true
+			return update(s.orm.Cols("targets", "released"), r, r.Id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
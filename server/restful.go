@@ -19,32 +19,93 @@ func (s *Server) PutUser(req *restful.Request, resp *restful.Response) {
 	userPut := &UserPut{}
 	err := req.ReadEntity(userPut)
 	if err != nil || userPut.Name == "" {
-		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: err.Error()})
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "bad request"})
 		return
 	}
-	user := &models.User{
-		Name: userPut.Name,
-	}
-	exists, err := s.orm.Get(user)
+	role, ok, err := s.findRole(userPut.Role)
 	if err != nil {
-		resp.WriteHeaderAndEntity(500, &GeneralResponse{Success: false, Message: err.Error()})
+		resp.WriteError(500, err)
 		return
 	}
-	user.Role = userPut.Role
-	user.Balance = userPut.Balance
-	if !exists {
-		_, err = s.orm.Insert(user)
-		if err != nil {
-			resp.WriteHeaderAndEntity(500, &GeneralResponse{Success: false, Message: err.Error()})
-			return
-		}
-	} else {
-		_, err = s.orm.Update(user, &models.User{Name: userPut.Name})
-		if err != nil {
-			resp.WriteHeaderAndEntity(500, &GeneralResponse{Success: false, Message: err.Error()})
+	if !ok {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "unknown role " + userPut.Role})
+		return
+	}
+	if userPut.Balance != nil {
+		if r, ok := req.Attribute("role").(*models.Role); !ok || !r.Has(models.PermTopUp) {
+			writeError(resp, newStatusError(403, "setting a balance takes permission "+models.PermTopUp))
 			return
 		}
 	}
+	ifMatch := req.HeaderParameter("If-Match")
+	var user *models.User
+	err = retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			user = &models.User{
+				Name: userPut.Name,
+			}
+			exists, err := session.Get(user)
+			if err != nil {
+				return nil, err
+			}
+			if ifMatch != "" && (!exists || !matchETag(ifMatch, user.Version)) {
+				return nil, errPreconditionFailed
+			}
+			if !exists || user.Role != role.Name {
+				roles := []*models.Role{role}
+				if exists {
+					cur, ok, err := s.findRole(user.Role)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						roles = append(roles, cur)
+					}
+				}
+				err = mayGrant(req, roles...)
+				if err != nil {
+					return nil, err
+				}
+			}
+			user.Role = userPut.Role
+			if !exists {
+				user.Balance = map[string]int{}
+				_, err = session.Insert(user)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				err = update(session, user, userPut.Name)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if userPut.Balance == nil {
+				return nil, nil
+			}
+			// balances only change through the ledger
+			kind := models.LedgerAdjustment
+			if !exists {
+				kind = models.LedgerCredit
+			}
+			diff := map[string]int{}
+			for k, v := range userPut.Balance {
+				diff[k] = v - user.Balance[k]
+			}
+			for k, v := range user.Balance {
+				if _, ok := userPut.Balance[k]; !ok {
+					diff[k] = -v
+				}
+			}
+			return nil, s.postLedger(session, user, kind, diff, "", actorOf(req), "balance set by PUT /user")
+		})
+		return err
+	})
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.AddHeader("ETag", etag(user.Version))
 	resp.WriteEntity(&GeneralResponse{Success: true})
 }
 
@@ -59,17 +120,106 @@ func (s *Server) GetUser(req *restful.Request, resp *restful.Response) {
 	ok, err := s.orm.Get(u)
 	if err != nil {
 		resp.WriteError(500, err)
+		return
 	}
 	if !ok {
 		resp.WriteErrorString(404, "Not Found")
+		return
+	}
+	quota, err := s.quotaGet(s.quotaOf(u), u.Name, "")
+	if err != nil {
+		resp.WriteError(500, err)
+		return
 	}
-	resp.WriteEntity(&UserPut{
-		Name:    u.Name,
-		Role:    u.Role,
-		Balance: u.Balance,
+	typeQuotas := map[string]*QuotaGet{}
+	for typ := range s.conf.Quota.Types {
+		typeQuotas[typ], err = s.quotaGet(s.typeQuota(typ), u.Name, typ)
+		if err != nil {
+			resp.WriteError(500, err)
+			return
+		}
+	}
+	role, ok, err := s.findRole(u.Role)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	permissions := []string{}
+	if ok {
+		permissions = role.Permissions
+	}
+	resp.AddHeader("ETag", etag(u.Version))
+	resp.WriteEntity(&UserGet{
+		Name:        u.Name,
+		Role:        u.Role,
+		Source:      u.Source,
+		Permissions: permissions,
+		Balance:     u.Balance,
+		Quota:       quota,
+		TypeQuotas:  typeQuotas,
 	})
 }
 
+func (s *Server) GetUserTransactions(req *restful.Request, resp *restful.Response) {
+	u := req.PathParameter("user")
+	sess := s.orm.Asc("id")
+	for _, p := range []struct {
+		param string
+		cond  string
+	}{{"from", "creation >= ?"}, {"to", "creation < ?"}} {
+		raw := req.QueryParameter(p.param)
+		if raw == "" {
+			continue
+		}
+		tm, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			resp.WriteError(400, err)
+			return
+		}
+		sess = sess.And(p.cond, tm)
+	}
+	entries := []*models.LedgerEntry{}
+	err := sess.Find(&entries, &models.LedgerEntry{User: u, Currency: req.QueryParameter("currency")})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	rslt := []*TransactionGet{}
+	for _, e := range entries {
+		rslt = append(rslt, &TransactionGet{
+			Id:       e.Id,
+			Currency: e.Currency,
+			Amount:   e.Amount,
+			Kind:     e.Kind,
+			Task:     e.Task,
+			Actor:    e.Actor,
+			Reason:   e.Reason,
+			Time:     e.Creation,
+		})
+	}
+	resp.WriteEntity(rslt)
+}
+
+func (s *Server) PostUserTransaction(req *restful.Request, resp *restful.Response) {
+	u := req.PathParameter("user")
+	p := &TransactionPost{}
+	err := req.ReadEntity(p)
+	if err != nil || len(p.Amount) == 0 {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "bad request"})
+		return
+	}
+	if p.Kind != models.LedgerCredit && p.Kind != models.LedgerAdjustment {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "kind must be credit or adjustment"})
+		return
+	}
+	err = s.charge(u, p.Kind, p.Amount, "", actorOf(req), p.Reason)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteEntity(&GeneralResponse{Success: true})
+}
+
 func (s *Server) GetUserTasks(req *restful.Request, resp *restful.Response) {
 	u := req.PathParameter("user")
 	tasks := []*models.Task{}
@@ -83,8 +233,13 @@ func (s *Server) GetUserTasks(req *restful.Request, resp *restful.Response) {
 		rslt = append(rslt, &TaskGet{
 			Name:         t.Name,
 			Instance:     t.Instance,
+			Instances:    t.AllInstances(),
+			Count:        t.Size(),
 			InstanceType: t.InstanceType,
 			Status:       t.Status,
+			Preemptible:  t.Preemptible,
+			After:        t.After,
+			Completed:    t.Completed,
 			Creation:     t.Creation,
 			QueueTime:    t.QueueTime,
 			EndTime:      t.EndTime,
@@ -105,17 +260,65 @@ func (s *Server) GetTask(req *restful.Request, resp *restful.Response) {
 		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "task not found"})
 		return
 	}
+	resp.AddHeader("ETag", etag(tsk.Version))
 	resp.WriteEntity(&TaskGet{
 		Name:         tsk.Name,
 		Instance:     tsk.Instance,
+		Instances:    tsk.AllInstances(),
+		Count:        tsk.Size(),
 		InstanceType: tsk.InstanceType,
 		Status:       tsk.Status,
+		Preemptible:  tsk.Preemptible,
+		After:        tsk.After,
+		Completed:    tsk.Completed,
 		Creation:     tsk.Creation,
 		QueueTime:    tsk.QueueTime,
 		EndTime:      tsk.EndTime,
 	})
 }
 
+func (s *Server) GetTaskEvents(req *restful.Request, resp *restful.Response) {
+	task := req.PathParameter("task")
+	t := &models.Task{Name: task}
+	ok, err := s.orm.Get(t)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	// names are taken again once deleted, show the tasks of one user only
+	owner := t.User
+	if !ok {
+		owner, _ = req.Attribute("user").(string)
+		role, _ := req.Attribute("role").(*models.Role)
+		tok, _ := req.Attribute("token").(*models.Token)
+		if role != nil && tok != nil && role.Has(models.PermViewTasks) && tok.Allows(models.ScopeAdmin) {
+			owner = ""
+		}
+	}
+	sess := s.orm.Asc("id")
+	if owner != "" {
+		// events from before owners were recorded have none
+		sess = sess.In("user", owner, "")
+	}
+	events := []*models.TaskEvent{}
+	err = sess.Find(&events, &models.TaskEvent{Task: task})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	rslt := []*TaskEventGet{}
+	for _, e := range events {
+		rslt = append(rslt, &TaskEventGet{
+			Actor:  e.Actor,
+			From:   e.From,
+			To:     e.To,
+			Reason: e.Reason,
+			Time:   e.Creation,
+		})
+	}
+	resp.WriteEntity(rslt)
+}
+
 func (s *Server) PostUserTask(req *restful.Request, resp *restful.Response) {
 	u := req.PathParameter("user")
 	task := &TaskPost{}
@@ -153,42 +356,71 @@ func (s *Server) PostUserTask(req *restful.Request, resp *restful.Response) {
 		resp.WriteError(500, err)
 		return
 	}
-	target := &models.InstanceTarget{Type: task.InstanceType}
-	if ok, err = s.orm.Desc("status").Get(target); err == nil {
-		if !ok {
-			resp.WriteEntity(&GeneralResponse{Success: false, Message: "instance type not found"})
-			return
-		}
-	} else {
+	if task.Count < 1 {
+		task.Count = 1
+	}
+	owner := &models.User{Name: u}
+	ok, err = s.orm.Get(owner)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if !ok {
+		writeError(resp, errUserNotFound)
+		return
+	}
+	err = s.checkInstanceQuota(owner, task.InstanceType, task.Count)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	targets, err := s.placeTask(&models.Task{Name: task.Name, InstanceType: task.InstanceType, User: u, Count: task.Count})
+	if err != nil {
 		resp.WriteError(500, err)
 		return
 	}
+	if targets == nil {
+		resp.WriteEntity(&GeneralResponse{Success: false, Message: "instance type not found or has too few targets"})
+		return
+	}
 	// TODO: better name generating
-	insName := "task-" + task.Name + "-" + strconv.Itoa(rand.Intn(99999999))
+	insNames := []string{}
+	for range targets {
+		insNames = append(insNames, "task-"+task.Name+"-"+strconv.Itoa(rand.Intn(99999999)))
+	}
 	tsk := &models.Task{
 		Name:         task.Name,
 		InstanceType: task.InstanceType,
 		Creation:     time.Now(),
 		EndTime:      time.Time{},
-		Status:       "creating",
-		TargetID:     target.Id,
-		Instance:     insName,
+		TargetID:     targets[0].Id,
+		Instance:     insNames[0],
 		User:         u,
+		Count:        task.Count,
+		Instances:    insNames,
 	}
-	_, err = s.orm.Insert(tsk)
+	actor := actorOf(req)
+	err = s.transitTask(s.orm, tsk, models.TaskCreating, actor, "task created")
 	if err != nil {
 		resp.WriteError(500, err)
 		return
 	}
-	insConf.Name = insName
-	err = r.RenderCreate(insConf, target.Target)
-	if err != nil {
-		s.orm.Delete(tsk)
-		resp.WriteEntity(&GeneralResponse{Success: false, Message: "instance creation error: " + err.Error()})
-		return
+	for i, target := range targets {
+		insConf.Name = insNames[i]
+		err = r.RenderCreate(insConf, target.Target)
+		if err != nil {
+			for _, created := range insNames[:i] {
+				derr := s.deleteInstance(created)
+				if derr != nil {
+					log.Println("ERROR:", derr)
+				}
+			}
+			s.transitTask(s.orm, tsk, models.TaskDeleted, actor, "instance creation error: "+err.Error())
+			resp.WriteEntity(&GeneralResponse{Success: false, Message: "instance creation error: " + err.Error()})
+			return
+		}
 	}
-	tsk.Status = "inactive"
-	_, err = s.orm.Update(tsk, &models.Task{Name: tsk.Name})
+	err = s.transitTask(s.orm, tsk, models.TaskInactive, actor, "instance created")
 	if err != nil {
 		resp.WriteError(500, err)
 	} else {
@@ -204,7 +436,16 @@ func (s *Server) PostTaskState(req *restful.Request, resp *restful.Response) {
 		resp.WriteError(400, err)
 		return
 	}
-	if stt.Status != "active" {
+	if stt.Status == models.TaskInactive {
+		err = s.cancelTask(task, req.HeaderParameter("If-Match"), actorOf(req))
+		if err != nil {
+			writeError(resp, err)
+			return
+		}
+		resp.WriteEntity(&GeneralResponse{Success: true, Message: models.TaskInactive})
+		return
+	}
+	if stt.Status != models.TaskActive {
 		resp.WriteEntity(&GeneralResponse{Success: false, Message: "action not supported"})
 		return
 	}
@@ -217,97 +458,275 @@ func (s *Server) PostTaskState(req *restful.Request, resp *restful.Response) {
 		resp.WriteEntity(&GeneralResponse{Success: false, Message: "life time too short"})
 		return
 	}
-	t := &models.Task{Name: task}
-	ok, err := s.orm.Get(t)
+	ifMatch := req.HeaderParameter("If-Match")
+	cur := &models.Task{Name: task}
+	ok, err := s.orm.Get(cur)
 	if err != nil {
 		resp.WriteError(500, err)
 		return
 	}
-	if !ok {
-		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "task not found"})
-		return
-	}
-	if t.Status != "inactive" {
-		resp.WriteEntity(&GeneralResponse{Success: false, Message: "cannot operate non inactive task"})
-		return
-	}
-	u := &models.User{Name: t.User}
-	ok, err = s.orm.Get(u)
-	if err != nil {
-		resp.WriteError(500, err)
-		return
-	}
-	if !ok {
-		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "user not found"})
-		return
-	}
-	it := &models.InstanceType{Name: t.InstanceType}
-	ok, err = s.orm.Get(it)
-	if err != nil {
-		resp.WriteError(500, err)
-		return
+	if ok && stt.Target != 0 {
+		if cur.Size() > 1 {
+			resp.WriteEntity(&GeneralResponse{Success: false, Message: "a target can only be given for single instance tasks"})
+			return
+		}
+		target := &models.InstanceTarget{Id: stt.Target}
+		found, err := s.orm.Get(target)
+		if err != nil {
+			resp.WriteError(500, err)
+			return
+		}
+		if !found || target.Type != cur.InstanceType {
+			resp.WriteEntity(&GeneralResponse{Success: false, Message: "target not found"})
+			return
+		}
 	}
-	if !ok {
-		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "instance type not found"})
+	if len(stt.After) > 0 {
+		if ok && cur.Status == models.TaskActive {
+			resp.WriteEntity(&GeneralResponse{Success: false, Message: "an active task cannot wait for others"})
+			return
+		}
+		err = checkAfter(task, stt.After)
+		if err != nil {
+			writeError(resp, err)
+			return
+		}
+		err = retryOnConflict(func() error {
+			return s.holdTask(task, stt.After, lifetime, stt.Preemptible, stt.Target, ifMatch, actorOf(req))
+		})
+		if err != nil {
+			writeError(resp, err)
+			return
+		}
+		// dependencies done already release it on the next expiry pass
+		s.expiry.Notify()
+		resp.WriteEntity(&GeneralResponse{Success: true, Message: models.TaskHeld})
 		return
 	}
-	for k, v := range it.Price {
-		price := v * int(lifetime/time.Minute)
-		if val, ok := u.Balance[k]; (ok) && (val >= price) {
-			u.Balance[k] -= price
-		} else {
-			resp.WriteEntity(&GeneralResponse{Success: false, Message: "balance is low"})
+	if ok && cur.Status == models.TaskActive {
+		// asking an active task to be active extends it by the given lifetime
+		var t *models.Task
+		err = retryOnConflict(func() error {
+			var err error
+			t, err = s.extendTask(task, lifetime, ifMatch, actorOf(req))
+			return err
+		})
+		if err != nil {
+			writeError(resp, err)
 			return
 		}
-	}
-	affectedRows, err := s.orm.Update(u, &models.User{Name: u.Name})
-	if err != nil {
-		resp.WriteError(500, err)
+		s.expiry.Notify()
+		resp.WriteEntity(&GeneralResponse{Success: true, Message: "extended until " + t.EndTime.Format(time.RFC3339)})
 		return
 	}
-	if affectedRows <= 0 {
-		resp.WriteHeaderAndEntity(500, &GeneralResponse{Success: false, Message: "probable concurrent write"})
+	status, err := s.requestActivation(task, lifetime, stt.Preemptible, stt.Target, ifMatch, actorOf(req))
+	if err != nil {
+		writeError(resp, err)
 		return
 	}
-	t.Status = "queued"
-	t.QueueTime = time.Now()
-	_, err = s.orm.Update(t, &models.Task{Name: t.Name})
+	resp.WriteEntity(&GeneralResponse{Success: true, Message: status})
+}
+
+// requestActivation queues an inactive task for lifetime and starts it at
+// once if the scheduler lets it, otherwise leaves it in the queue. It returns
+// the status the task ends up in.
+func (s *Server) requestActivation(name string, lifetime time.Duration, preemptible bool, pin int64, ifMatch string, actor string) (string, error) {
+	var t *models.Task
+	err := retryOnConflict(func() error {
+		var err error
+		t, err = s.queueTask(name, lifetime, preemptible, ifMatch, actor)
+		return err
+	})
 	if err != nil {
-		resp.WriteError(500, err)
-		return
+		return "", err
 	}
-	ok, err = s.activateTask(t, lifetime, nil)
+	ok, err := s.startTask(t, lifetime, pin, actor)
 	if err != nil {
 		log.Println("ERROR:", err)
-		resp.WriteError(500, err)
-		return
+		if t.Status == models.TaskQueued {
+			rerr := s.deactivateTask(t, systemActor, "activation failed: "+err.Error())
+			if rerr != nil {
+				log.Println("ERROR:", rerr)
+			}
+		}
+		return "", err
 	}
 	if ok {
-		resp.WriteEntity(&GeneralResponse{Success: true, Message: "active"})
-	} else {
-		// put into queue
-		q := &models.Queue{
-			User:         t.User,
-			Task:         t.Name,
-			LifeTime:     lifetime,
-			InstanceType: t.InstanceType,
+		return models.TaskActive, nil
+	}
+	// put into queue
+	q := &models.Queue{
+		User:         t.User,
+		Task:         t.Name,
+		LifeTime:     lifetime,
+		InstanceType: t.InstanceType,
+		TargetID:     pin,
+		Count:        t.Size(),
+		Preemptible:  t.Preemptible,
+	}
+	_, err = s.orm.Insert(q)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return "", err
+	}
+	// wake the dispatcher, it may preempt tasks to start this one
+	s.expiry.Notify()
+	return models.TaskQueued, nil
+}
+
+// queueTask charges the owner of an inactive task for lifetime, at the spot
+// price when preemptible, and marks the task queued, both in one transaction.
+func (s *Server) queueTask(name string, lifetime time.Duration, preemptible bool, ifMatch string, actor string) (*models.Task, error) {
+	t := &models.Task{Name: name}
+	_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+		ok, err := session.Get(t)
+		if err != nil {
+			return nil, err
 		}
-		_, err = s.orm.Insert(q)
+		if !ok {
+			return nil, errTaskNotFound
+		}
+		if !matchETag(ifMatch, t.Version) {
+			return nil, errPreconditionFailed
+		}
+		if !models.TaskStates.CanTransit(t.Status, models.TaskQueued) {
+			return nil, errIllegalTransition(t.Status, models.TaskQueued)
+		}
+		u := &models.User{Name: t.User}
+		ok, err = session.Get(u)
 		if err != nil {
-			log.Println("ERROR:", err)
-			resp.WriteError(500, err)
-			return
+			return nil, err
+		}
+		if !ok {
+			return nil, errUserNotFound
+		}
+		it := &models.InstanceType{Name: t.InstanceType}
+		ok, err = session.Get(it)
+		if err != nil {
+			return nil, err
 		}
-		resp.WriteEntity(&GeneralResponse{Success: true, Message: "queued"})
+		if !ok {
+			return nil, errTypeNotFound
+		}
+		err = s.checkActivationQuota(session, u, t, lifetime)
+		if err != nil {
+			return nil, err
+		}
+		if preemptible && len(it.SpotPrice) == 0 {
+			return nil, newStatusError(200, "instance type has no spot price")
+		}
+		t.Preemptible = preemptible
+		// a group pays for every instance
+		price := map[string]int{}
+		amounts := map[string]int{}
+		for k, v := range priceOf(it, t) {
+			price[k] = v * t.Size()
+			amounts[k] = -price[k] * int(lifetime/time.Minute)
+		}
+		t.LifeTime = lifetime
+		t.Price = price
+		err = s.postLedger(session, u, models.LedgerDebit, amounts, t.Name, actor, "activation for "+lifetime.String())
+		if err != nil {
+			return nil, err
+		}
+		t.QueueTime = time.Now()
+		return nil, s.transitTask(session, t, models.TaskQueued, actor, "activation requested for "+lifetime.String())
+	})
+	return t, err
+}
+
+// priceOf returns the price per minute and instance of a task's activation.
+func priceOf(it *models.InstanceType, t *models.Task) map[string]int {
+	if t.Preemptible {
+		return it.SpotPrice
 	}
+	return it.Price
 }
 
-func (s *Server) activateTask(task *models.Task, lifetime time.Duration, tgt *models.InstanceTarget) (bool, error) {
-	// FIXME: Dequeue and Requeue logic should be processed outside
-	// _, err = s.orm.Delete(&models.Queue{Task: task.Name})
-	// if err != nil {
-	// 	return false, err
-	// }
+// extendTask charges the owner of an active task for extra minutes and pushes
+// its end time, unless that would starve the queue of its instance type.
+func (s *Server) extendTask(name string, extra time.Duration, ifMatch string, actor string) (*models.Task, error) {
+	t := &models.Task{Name: name}
+	_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+		ok, err := session.Get(t)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTaskNotFound
+		}
+		if !matchETag(ifMatch, t.Version) {
+			return nil, errPreconditionFailed
+		}
+		if t.Status != models.TaskActive {
+			return nil, newStatusError(409, "only active tasks can be extended")
+		}
+		err = s.checkExtensionQuota(session, t, extra)
+		if err != nil {
+			return nil, err
+		}
+		endTime := t.EndTime.Add(extra)
+		for _, id := range t.AllTargets() {
+			reserved, err := s.reservedAgainst(session, &models.InstanceTarget{Id: id, Type: t.InstanceType}, t.User, t.EndTime, endTime)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				return nil, newStatusError(200, "extension refused, a target is reserved")
+			}
+		}
+		if limit := s.conf.Queue.ExtendStarvationLimit; limit > 0 {
+			starves, err := s.extensionStarves(t, endTime, limit)
+			if err != nil {
+				return nil, err
+			}
+			if starves {
+				return nil, newStatusError(200, "extension refused, queued tasks would wait too long")
+			}
+		}
+		it := &models.InstanceType{Name: t.InstanceType}
+		ok, err = session.Get(it)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTypeNotFound
+		}
+		u := &models.User{Name: t.User}
+		ok, err = session.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errUserNotFound
+		}
+		amounts := map[string]int{}
+		for k, v := range priceOf(it, t) {
+			amounts[k] = -v * t.Size() * int(extra/time.Minute)
+		}
+		err = s.postLedger(session, u, models.LedgerDebit, amounts, t.Name, actor, "extension by "+extra.String())
+		if err != nil {
+			return nil, err
+		}
+		t.EndTime = endTime
+		t.LifeTime += extra
+		err = update(session, t, t.Name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.recordTaskEvent(session, t, t.Status, t.Status, actor, "extended by "+extra.String()+" until "+endTime.Format(time.RFC3339))
+	})
+	return t, err
+}
+
+// activateTask claims targets for a queued task, one per instance, and starts
+// its instances there. It is all or nothing: false means a target was taken in
+// the meantime and none is kept.
+func (s *Server) activateTask(task *models.Task, lifetime time.Duration, tgts []*models.InstanceTarget, actor string) (bool, error) {
+	instances := task.AllInstances()
+	if len(tgts) != len(instances) {
+		return false, fmt.Errorf("task %v has %v instances, got %v targets", task.Name, len(instances), len(tgts))
+	}
 	it := &models.InstanceType{Name: task.InstanceType}
 	ok, err := s.orm.Get(it)
 	if err != nil {
@@ -324,65 +743,105 @@ func (s *Server) activateTask(task *models.Task, lifetime time.Duration, tgt *mo
 	if err != nil {
 		return false, err
 	}
-	// Get and set target
-	var target *models.InstanceTarget
-	if tgt == nil {
-		target = &models.InstanceTarget{Type: task.InstanceType, Status: "idle"}
-		ok, err = s.orm.Get(target)
-		if err != nil {
-			return false, err
-		}
-		if !ok {
-			return false, nil
+	targets := []*models.InstanceTarget{}
+	release := func() {
+		for _, target := range targets {
+			rerr := s.releaseTarget(target.Id, task.Name)
+			if rerr != nil {
+				log.Println("ERROR:", rerr)
+			}
 		}
-		target.Status = "busy"
-		target.Instance = task.Instance
-		target.Task = task.Name
-		affectedRows, err := s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
+	}
+	for i, tgt := range tgts {
+		target := &models.InstanceTarget{Id: tgt.Id}
+		err = s.claimTarget(target, task.Name, instances[i])
 		if err != nil {
+			release()
+			if err == errConflict {
+				return false, nil
+			}
 			return false, err
 		}
-		if affectedRows <= 0 {
-			return false, fmt.Errorf("probable concurrent write")
-		}
-	} else {
-		target = tgt
-	}
-	err = r.RenderStart(task.Instance, conf.InstancePut, target.Target)
-	if err != nil {
-		target.Status = "idle"
-		s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
-		return false, err
+		targets = append(targets, target)
 	}
-	timeout := lifetime
-	go func() {
-		time.Sleep(timeout)
-		err := s.killTask(task)
+	ids := []int64{}
+	for i, target := range targets {
+		err = r.RenderStart(instances[i], conf.InstancePut, target.Target)
 		if err != nil {
-			log.Println("ERROR:", err)
+			for _, started := range instances[:i] {
+				serr := s.stopInstance(started)
+				if serr != nil {
+					log.Println("ERROR:", serr)
+				}
+			}
+			release()
+			return false, err
 		}
-	}()
-	task.Status = "active"
-	task.EndTime = time.Now().Add(lifetime)
-	task.TargetID = target.Id
-	_, err = s.orm.Update(task, &models.Task{Name: task.Name})
+		ids = append(ids, target.Id)
+	}
+	task.ActiveTime = time.Now()
+	task.EndTime = task.ActiveTime.Add(lifetime)
+	task.TargetID = ids[0]
+	task.TargetIDs = ids
+	err = s.transitTask(s.orm, task, models.TaskActive, actor, fmt.Sprintf("activated on targets %v until %v", ids, task.EndTime.Format(time.RFC3339)))
 	if err != nil {
 		return true, err
 	}
+	s.expiry.Notify()
 	return true, nil
 }
 
-func (s *Server) killTask(task *models.Task) error {
-	log.Println("killing task", task)
-	task.Status = "terminating"
-	affectedRows, err := s.orm.Update(task, &models.Task{Name: task.Name})
+// completeTask kills a task whose activation ended the way it was meant to,
+// which lets the tasks held after it go.
+func (s *Server) completeTask(task *models.Task, actor string, reason string) error {
+	task.Completed = time.Now()
+	return s.killTask(task, actor, reason)
+}
+
+func (s *Server) killTask(task *models.Task, actor string, reason string) error {
+	err := s.stopTask(task, actor, reason)
 	if err != nil {
 		return err
 	}
-	if affectedRows <= 0 {
+	return s.dispatchFreed(task)
+}
+
+// stopTask kills a task without handing its targets to the queue, for the
+// dispatcher, whose next pass picks them up.
+func (s *Server) stopTask(task *models.Task, actor string, reason string) error {
+	log.Println("killing task", task)
+	err := s.transitTask(s.orm, task, models.TaskTerminating, actor, reason)
+	if err == errConflict {
+		// changed since it was read, whoever changed it is in charge now
 		return nil
 	}
-	op, err := s.lxd.UpdateInstanceState(task.Instance, api.InstanceStatePut{
+	if err != nil {
+		return err
+	}
+	err = s.stopInstances(task)
+	if err != nil {
+		return err
+	}
+	return s.releaseTask(task, actor)
+}
+
+// stopInstances stops every instance of a task, it tries all of them before
+// returning the first error.
+func (s *Server) stopInstances(task *models.Task) error {
+	var first error
+	for _, instance := range task.AllInstances() {
+		err := s.stopInstance(instance)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// stopInstance stops an instance statefully, falling back to a forced stop when
+// the instance or the host doesn't support it. Stopped instances are fine.
+func (s *Server) stopInstance(instance string) error {
+	op, err := s.lxd.UpdateInstanceState(instance, api.InstanceStatePut{
 		Action:   "stop",
 		Force:    false,
 		Stateful: true,
@@ -396,7 +855,7 @@ func (s *Server) killTask(task *models.Task) error {
 		err = op.Wait()
 		if err != nil && !strings.Contains(err.Error(), "already stopped") {
 			if strings.Contains(err.Error(), "migration.stateful") || strings.Contains(err.Error(), "install CRIU") {
-				op, err = s.lxd.UpdateInstanceState(task.Instance, api.InstanceStatePut{
+				op, err = s.lxd.UpdateInstanceState(instance, api.InstanceStatePut{
 					Action:   "stop",
 					Force:    true,
 					Stateful: false,
@@ -415,93 +874,152 @@ func (s *Server) killTask(task *models.Task) error {
 			}
 		}
 	}
-	task.Status = "inactive"
-	_, err = s.orm.Update(task, &models.Task{Name: task.Name})
+	return nil
+}
+
+// finishKill marks a stopped task inactive, frees its targets and hands them
+// to the queue.
+func (s *Server) finishKill(task *models.Task, actor string) error {
+	err := s.releaseTask(task, actor)
 	if err != nil {
 		return err
 	}
-	log.Println("killed task", task)
-	// FIXME: should execute the after things
-	target := &models.InstanceTarget{Id: task.TargetID}
-	ok, err := s.orm.Get(target)
+	return s.dispatchFreed(task)
+}
+
+// releaseTask marks a stopped task inactive and frees its targets.
+func (s *Server) releaseTask(task *models.Task, actor string) error {
+	err := s.deactivateTask(task, actor, "instance stopped")
 	if err != nil {
 		return err
 	}
-	if !ok {
+	log.Println("killed task", task)
+	for _, id := range task.AllTargets() {
+		err = s.releaseTarget(id, task.Name)
+		if err != nil {
+			return err
+		}
+	}
+	// the expiry pass releases the tasks held after this one
+	s.expiry.Notify()
+	return nil
+}
+
+// dispatchFreed hands the targets of a killed task to the queue. Only the
+// lease holder dequeues, other processes leave it to its next pass.
+func (s *Server) dispatchFreed(task *models.Task) error {
+	if s.leader.Fence() != nil {
 		return nil
 	}
-	queueItem := &models.Queue{}
-	ok, err = s.orm.Where("instance_type = ?", task.InstanceType).Asc("creation").Get(queueItem)
+	return s.dispatchQueue(task.InstanceType)
+}
+
+// claimTarget re-reads a target and marks it busy for an instance of a task,
+// errConflict means it is not idle any more.
+func (s *Server) claimTarget(target *models.InstanceTarget, task string, instance string) error {
+	ok, err := s.orm.Get(target)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		// free the targets
-		target.Status = "idle"
-		_, err = s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
-		return err
+	if !ok || target.Status != "idle" {
+		return errConflict
 	}
-	_, err = s.orm.Delete(queueItem)
-	if err != nil {
-		// free the targets
+	target.Status = "busy"
+	target.Instance = instance
+	target.Task = task
+	return update(s.orm, target, target.Id)
+}
+
+// releaseTarget marks a target idle, unless it has been handed to another
+// task in the meantime.
+func (s *Server) releaseTarget(id int64, task string) error {
+	return retryOnConflict(func() error {
+		target := &models.InstanceTarget{Id: id}
+		ok, err := s.orm.Get(target)
+		if err != nil {
+			return err
+		}
+		if !ok || target.Task != task || target.Status == "idle" {
+			return nil
+		}
 		target.Status = "idle"
-		_, err = s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
-		return err
-	}
-	nt := &models.Task{Name: queueItem.Task}
-	ok, err = s.orm.Get(task)
+		return update(s.orm, target, target.Id)
+	})
+}
+
+func (s *Server) dispatchQueues() error {
+	types := []*models.InstanceType{}
+	err := s.orm.Find(&types)
 	if err != nil {
-		// free the targets
-		target.Status = "idle"
-		_, err = s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
-		return err
-	}
-	if !ok {
-		// free the targets
-		target.Status = "idle"
-		_, err = s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
 		return err
 	}
-	log.Println("starting task", nt, "on", target)
-	ok, err = s.activateTask(nt, queueItem.LifeTime, target)
-	if err != nil || !ok {
-		target.Status = "idle"
-		_, err = s.orm.Update(target, &models.InstanceTarget{Id: target.Id})
+	for _, typ := range types {
+		err = s.dispatchQueue(typ.Name)
 		if err != nil {
-			return err
-		}
-		// Requeue
-		_, err = s.orm.Insert(queueItem)
-		if err != nil {
-			return err
+			log.Println("ERROR:", err)
 		}
 	}
-	log.Println("started task", nt, "on", target)
 	return nil
 }
 
-func (s *Server) estimateQueueTime(instanceType string, creationBefore time.Time) (time.Duration, error) {
-	queues := []*models.Queue{}
-	err := s.orm.Where("instance_type = ?", instanceType).Where("creation < ?", creationBefore).Find(queues)
-	if err != nil {
-		return 0, err
-	}
-	total := time.Duration(0)
-	for _, qi := range queues {
-		total += qi.LifeTime
-	}
-	if ok, _ := s.orm.Exist(&models.InstanceTarget{Type: instanceType, Status: "idle"}); !ok {
-		leastTask := &models.Task{InstanceType: instanceType, Status: "active"}
-		ok, err := s.orm.Desc("end_time").Get(leastTask)
+// dispatchQueue starts queued tasks of an instance type on the targets the
+// scheduler assigns them to, preempting tasks when that lets a normal one
+// start, until nothing changes. Callers must hold the cron lease.
+func (s *Server) dispatchQueue(instanceType string) error {
+	for {
+		now := time.Now()
+		entries, rows, err := s.queueEntries(instanceType, now)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		entries, err = s.withinQuota(instanceType, entries)
 		if err != nil {
-			return 0, err
+			return err
 		}
-		if !ok {
-			return total, nil
+		targets, err := s.schedulerTargets(instanceType, now)
+		if err != nil {
+			return err
+		}
+		assigned := s.sched.Schedule(entries, targets, now)
+		if len(assigned) == 0 {
+			preempted, err := s.preempt(instanceType, entries, targets, now)
+			if err != nil || !preempted {
+				return err
+			}
+			continue
+		}
+		for _, a := range assigned {
+			queueItem := rows[a.Entry.ID]
+			affectedRows, err := s.orm.Delete(&models.Queue{Id: queueItem.Id})
+			if err != nil {
+				return err
+			}
+			if affectedRows <= 0 {
+				continue
+			}
+			nt := &models.Task{Name: queueItem.Task}
+			ok, err := s.orm.Get(nt)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			log.Println("starting task", nt)
+			ok, err = s.activateTask(nt, queueItem.LifeTime, instanceTargets(a), systemActor)
+			if err != nil || !ok {
+				// Requeue, keeping the creation time so the task keeps its
+				// place in the queue
+				queueItem.Id = 0
+				_, rerr := s.orm.NoAutoTime().Insert(queueItem)
+				if rerr != nil {
+					return rerr
+				}
+				return err
+			}
+			log.Println("started task", nt)
 		}
-		total += time.Until(leastTask.EndTime)
 	}
-	return total, nil
 }
 
 func (s *Server) GetEstimatedQueueTime(req *restful.Request, resp *restful.Response) {
@@ -518,7 +1036,7 @@ func (s *Server) GetEstimatedQueueTime(req *restful.Request, resp *restful.Respo
 	}
 	qt, err := s.estimateQueueTime(instanceType, tm)
 	if err != nil {
-		resp.WriteError(500, err)
+		writeError(resp, err)
 		return
 	}
 	resp.WriteEntity(&QueueTimeGet{
@@ -526,44 +1044,87 @@ func (s *Server) GetEstimatedQueueTime(req *restful.Request, resp *restful.Respo
 	})
 }
 
-func (s *Server) DeleteTask(req *restful.Request, resp *restful.Response) {
-	task := req.PathParameter("task")
-	t := &models.Task{Name: task}
+func (s *Server) GetTaskQueue(req *restful.Request, resp *restful.Response) {
+	t := &models.Task{Name: req.PathParameter("task")}
 	ok, err := s.orm.Get(t)
 	if err != nil {
 		resp.WriteError(500, err)
 		return
 	}
 	if !ok {
-		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "task not found"})
+		writeError(resp, errTaskNotFound)
 		return
 	}
-	if t.Status != "inactive" {
-		resp.WriteEntity(&GeneralResponse{Success: false, Message: "task is not inactive"})
+	pos, start, err := s.taskQueuePosition(t)
+	if err != nil {
+		writeError(resp, err)
 		return
 	}
-	t.Status = "deleting"
-	_, err = s.orm.Update(t, &models.Task{Name: task})
+	resp.WriteEntity(&TaskQueueGet{
+		Position: pos,
+		Start:    start,
+		Wait:     time.Until(start).Round(time.Second).String(),
+	})
+}
+
+func (s *Server) GetTaskPipeline(req *restful.Request, resp *restful.Response) {
+	t := &models.Task{Name: req.PathParameter("task")}
+	ok, err := s.orm.Get(t)
 	if err != nil {
 		resp.WriteError(500, err)
 		return
 	}
-	op, err := s.lxd.DeleteInstance(t.Instance)
+	if !ok {
+		writeError(resp, errTaskNotFound)
+		return
+	}
+	tasks, err := s.pipeline(t)
 	if err != nil {
-		resp.WriteEntity(&GeneralResponse{Success: false, Message: "failed to delete instance: " + err.Error()})
+		resp.WriteError(500, err)
 		return
 	}
-	err = op.Wait()
+	resp.WriteEntity(pipelineGet(tasks))
+}
+
+func (s *Server) DeleteTask(req *restful.Request, resp *restful.Response) {
+	task := req.PathParameter("task")
+	ifMatch := req.HeaderParameter("If-Match")
+	var t *models.Task
+	err := retryOnConflict(func() error {
+		t = &models.Task{Name: task}
+		ok, err := s.orm.Get(t)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errTaskNotFound
+		}
+		if !matchETag(ifMatch, t.Version) {
+			return errPreconditionFailed
+		}
+		return s.transitTask(s.orm, t, models.TaskDeleting, actorOf(req), "deletion requested")
+	})
 	if err != nil {
-		resp.WriteEntity(&GeneralResponse{Success: false, Message: "failed to delete instance: " + err.Error()})
+		writeError(resp, err)
 		return
 	}
-	_, err = s.orm.Delete(t)
+	for _, instance := range t.AllInstances() {
+		err = s.deleteInstance(instance)
+		if err != nil {
+			resp.WriteEntity(&GeneralResponse{Success: false, Message: "failed to delete instance: " + err.Error()})
+			return
+		}
+	}
+	err = s.transitTask(s.orm, t, models.TaskDeleted, actorOf(req), "instance deleted")
 	if err != nil {
 		resp.WriteError(500, err)
-	} else {
-		resp.WriteEntity(&GeneralResponse{Success: true})
+		return
 	}
+	_, err = s.orm.Delete(&models.Schedule{Task: t.Name})
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	resp.WriteEntity(&GeneralResponse{Success: true})
 }
 
 func (s *Server) GetInstanceState(req *restful.Request, resp *restful.Response) {
@@ -597,6 +1158,24 @@ func (s *Server) PutInstanceState(req *restful.Request, resp *restful.Response)
 		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "unknown action"})
 		return
 	}
+	if entity.Action == "stop" {
+		// stopping an instance of an active task ends the whole task early, so
+		// the remaining time is refunded and the targets go to the queue
+		t, ok, err := s.taskOfInstance(instance)
+		if err != nil {
+			resp.WriteError(500, err)
+			return
+		}
+		if ok && t.Status == models.TaskActive {
+			err = s.completeTask(t, actorOf(req), "stopped by user")
+			if err != nil {
+				resp.WriteEntity(&GeneralResponse{Success: false, Message: err.Error()})
+				return
+			}
+			resp.WriteEntity(&GeneralResponse{Success: true})
+			return
+		}
+	}
 	op, err := s.lxd.UpdateInstanceState(instance, api.InstanceStatePut{
 		Action:   entity.Action,
 		Force:    entity.Force,
@@ -622,17 +1201,85 @@ func (s *Server) PutUserToken(req *restful.Request, resp *restful.Response) {
 		resp.WriteError(400, err)
 		return
 	}
+	err = s.mayActFor(req, u)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	scopes, expires, err := tokenLimits(req, p)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	taken, err := s.directoryName(p.Name)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if taken {
+		writeError(resp, newStatusError(409, "token name "+p.Name+" is a user name"))
+		return
+	}
+	secret, err := models.NewSecret()
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	hash, err := models.HashSecret(secret)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
 	token := &models.Token{
-		Name:   p.Name,
-		Secret: p.Secret,
-		User:   u,
+		Name:    p.Name,
+		Secret:  hash,
+		User:    u,
+		Scopes:  scopes,
+		Expires: expires,
 	}
 	_, err = s.orm.Insert(token)
 	if err != nil {
 		resp.WriteError(500, err)
-	} else {
-		resp.WriteEntity(&GeneralResponse{Success: true})
+		return
+	}
+	resp.WriteEntity(&TokenSecretGet{Name: token.Name, Secret: secret, Expires: token.Expires})
+}
+
+// tokenLimits validates the scopes and expiry of a new token. A token never
+// gets more than the token that creates it: no scope it lacks and no later
+// expiry.
+func tokenLimits(req *restful.Request, p *TokenPut) ([]string, time.Time, error) {
+	for _, scope := range p.Scopes {
+		known := false
+		for _, s := range models.Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, time.Time{}, newStatusError(400, "unknown scope "+scope)
+		}
+	}
+	if !p.Expires.IsZero() && !p.Expires.After(time.Now()) {
+		return nil, time.Time{}, newStatusError(400, "expiry is in the past")
+	}
+	scopes, expires := p.Scopes, p.Expires
+	creator, ok := req.Attribute("token").(*models.Token)
+	if !ok {
+		return scopes, expires, nil
+	}
+	if len(creator.Scopes) > 0 {
+		if len(scopes) == 0 {
+			scopes = creator.Scopes
+		}
+		for _, scope := range scopes {
+			if !creator.Allows(scope) {
+				return nil, time.Time{}, newStatusError(403, "the token used lacks scope "+scope)
+			}
+		}
+	}
+	if !creator.Expires.IsZero() && (expires.IsZero() || expires.After(creator.Expires)) {
+		expires = creator.Expires
 	}
+	return scopes, expires, nil
 }
 
 func (s *Server) GetUserToken(req *restful.Request, resp *restful.Response) {
@@ -645,10 +1292,17 @@ func (s *Server) GetUserToken(req *restful.Request, resp *restful.Response) {
 	}
 	rslt := TokenGet{}
 	for _, val := range tokens {
-		rslt = append(rslt, struct {
-			Name string `json:"name"`
-		}{
-			Name: val.Name,
+		scopes := val.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		rslt = append(rslt, &TokenInfoGet{
+			Name:     val.Name,
+			Scopes:   scopes,
+			Expires:  val.Expires,
+			LastUsed: val.LastUsed,
+			LastIP:   val.LastIP,
+			Creation: val.Creation,
 		})
 	}
 	resp.WriteEntity(rslt)
@@ -671,6 +1325,11 @@ func (s *Server) DeleteUserToken(req *restful.Request, resp *restful.Response) {
 		resp.WriteHeaderAndEntity(404, &GeneralResponse{Success: false, Message: "user and token not match"})
 		return
 	}
+	err = s.mayActFor(req, u)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
 	_, err = s.orm.Delete(tok)
 	if err != nil {
 		resp.WriteError(500, err)
@@ -692,11 +1351,23 @@ func (s *Server) GetInstanceTypes(req *restful.Request, resp *restful.Response)
 			Name:        v.Name,
 			Description: v.Description,
 			Price:       v.Price,
+			SpotPrice:   v.SpotPrice,
+			IdleAfter:   durationString(v.IdleAfter),
+			IdleCPU:     v.IdleCPU,
+			IdleNetwork: v.IdleNetwork,
 		})
 	}
 	resp.WriteEntity(rslt)
 }
 
+// durationString shows a duration, or nothing when it is 0.
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
 func (s *Server) GetInstanceType(req *restful.Request, resp *restful.Response) {
 	r := &models.InstanceType{Name: req.PathParameter("type")}
 	ok, err := s.orm.Get(r)
@@ -711,6 +1382,10 @@ func (s *Server) GetInstanceType(req *restful.Request, resp *restful.Response) {
 		Name:        r.Name,
 		Description: r.Description,
 		Price:       r.Price,
+		SpotPrice:   r.SpotPrice,
+		IdleAfter:   durationString(r.IdleAfter),
+		IdleCPU:     r.IdleCPU,
+		IdleNetwork: r.IdleNetwork,
 	})
 }
 
@@ -729,7 +1404,17 @@ func (s *Server) PutInstanceType(req *restful.Request, resp *restful.Response) {
 	}
 	insType.Configure = r.Configure
 	insType.Price = r.Price
+	insType.SpotPrice = r.SpotPrice
 	insType.Description = r.Description
+	if r.IdleAfter != "" {
+		insType.IdleAfter, err = time.ParseDuration(r.IdleAfter)
+		if err != nil || insType.IdleAfter < 0 {
+			resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "invalid idle-after"})
+			return
+		}
+	}
+	insType.IdleCPU = r.IdleCPU
+	insType.IdleNetwork = r.IdleNetwork
 	rd, err := renderer.NewRenderer(s.lxd, map[string]interface{}{})
 	if err != nil {
 		resp.WriteError(500, err)
@@ -747,7 +1432,7 @@ func (s *Server) PutInstanceType(req *restful.Request, resp *restful.Response) {
 				return nil, err
 			}
 		} else {
-			_, err = session.Update(insType, &models.InstanceType{Name: insType.Name})
+			_, err = session.ID(insType.Name).AllCols().Update(insType)
 			if err != nil {
 				return nil, err
 			}
@@ -797,3 +1482,388 @@ func (s *Server) DeleteInstanceType(req *restful.Request, resp *restful.Response
 		resp.WriteEntity(&GeneralResponse{Success: true})
 	}
 }
+
+func (s *Server) GetLease(req *restful.Request, resp *restful.Response) {
+	lease := &models.Lease{Name: cronLease}
+	ok, err := s.orm.Get(lease)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if !ok {
+		resp.WriteErrorString(404, "Not Found")
+		return
+	}
+	resp.WriteEntity(&LeaseGet{
+		Name:    lease.Name,
+		Holder:  lease.Holder,
+		Token:   lease.Token,
+		Expire:  lease.Expire,
+		Renewed: lease.Renewed,
+		Self:    lease.Holder == s.leader.holder && time.Now().Before(lease.Expire),
+	})
+}
+
+func (s *Server) PostReservation(req *restful.Request, resp *restful.Response) {
+	rp := &ReservationPost{}
+	err := req.ReadEntity(rp)
+	if err != nil {
+		resp.WriteError(400, err)
+		return
+	}
+	if rp.Count <= 0 || !rp.End.After(rp.Start) || !rp.End.After(time.Now()) {
+		resp.WriteEntity(&GeneralResponse{Success: false, Message: "invalid count or window"})
+		return
+	}
+	r := &models.Reservation{
+		InstanceType: rp.InstanceType,
+		Count:        rp.Count,
+		Start:        rp.Start,
+		End:          rp.End,
+		Users:        rp.Users,
+		Description:  rp.Description,
+		Creator:      actorOf(req),
+	}
+	err = s.createReservation(r)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteEntity(reservationGet(r))
+}
+
+func reservationGet(r *models.Reservation) *ReservationGet {
+	return &ReservationGet{
+		Id:           r.Id,
+		InstanceType: r.InstanceType,
+		Count:        r.Count,
+		Start:        r.Start,
+		End:          r.End,
+		Users:        r.Users,
+		Targets:      r.Targets,
+		Released:     r.Released,
+		Description:  r.Description,
+		Creator:      r.Creator,
+		Creation:     r.Creation,
+	}
+}
+
+func (s *Server) GetReservations(req *restful.Request, resp *restful.Response) {
+	reservations := []*models.Reservation{}
+	err := s.orm.Asc("start_time").Find(&reservations)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	rslt := []*ReservationGet{}
+	for _, r := range reservations {
+		rslt = append(rslt, reservationGet(r))
+	}
+	resp.WriteEntity(rslt)
+}
+
+func (s *Server) GetReservation(req *restful.Request, resp *restful.Response) {
+	id, err := strconv.ParseInt(req.PathParameter("reservation"), 10, 64)
+	if err != nil {
+		resp.WriteError(400, err)
+		return
+	}
+	r := &models.Reservation{Id: id}
+	ok, err := s.orm.Get(r)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if !ok {
+		resp.WriteErrorString(404, "Not Found")
+		return
+	}
+	resp.WriteEntity(reservationGet(r))
+}
+
+func (s *Server) DeleteReservation(req *restful.Request, resp *restful.Response) {
+	id, err := strconv.ParseInt(req.PathParameter("reservation"), 10, 64)
+	if err != nil {
+		resp.WriteError(400, err)
+		return
+	}
+	affectedRows, err := s.orm.Delete(&models.Reservation{Id: id})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if affectedRows <= 0 {
+		resp.WriteErrorString(404, "Not Found")
+		return
+	}
+	s.expiry.Notify()
+	resp.WriteEntity(&GeneralResponse{Success: true})
+}
+
+func (s *Server) PostUserSchedule(req *restful.Request, resp *restful.Response) {
+	p := &SchedulePost{}
+	err := req.ReadEntity(p)
+	if err != nil {
+		resp.WriteError(400, err)
+		return
+	}
+	r, spec, err := s.scheduleFrom(req.PathParameter("user"), p)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	r.NextRun = spec.Next(time.Now())
+	_, err = s.orm.Insert(r)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	s.expiry.Notify()
+	resp.WriteEntity(scheduleGet(r))
+}
+
+func (s *Server) GetUserSchedules(req *restful.Request, resp *restful.Response) {
+	schedules := []*models.Schedule{}
+	err := s.orm.Asc("id").Find(&schedules, &models.Schedule{User: req.PathParameter("user")})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	rslt := []*ScheduleGet{}
+	for _, r := range schedules {
+		rslt = append(rslt, scheduleGet(r))
+	}
+	resp.WriteEntity(rslt)
+}
+
+// userSchedule reads the schedule in the path, errScheduleNotFound when it
+// belongs to another user.
+func (s *Server) userSchedule(req *restful.Request) (*models.Schedule, error) {
+	id, err := strconv.ParseInt(req.PathParameter("schedule"), 10, 64)
+	if err != nil {
+		return nil, errScheduleNotFound
+	}
+	r := &models.Schedule{Id: id}
+	ok, err := s.orm.Get(r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || r.User != req.PathParameter("user") {
+		return nil, errScheduleNotFound
+	}
+	return r, nil
+}
+
+func (s *Server) GetUserSchedule(req *restful.Request, resp *restful.Response) {
+	r, err := s.userSchedule(req)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.AddHeader("ETag", etag(r.Version))
+	resp.WriteEntity(scheduleGet(r))
+}
+
+func (s *Server) PutUserSchedule(req *restful.Request, resp *restful.Response) {
+	p := &SchedulePost{}
+	err := req.ReadEntity(p)
+	if err != nil {
+		resp.WriteError(400, err)
+		return
+	}
+	cur, err := s.userSchedule(req)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	if !matchETag(req.HeaderParameter("If-Match"), cur.Version) {
+		writeError(resp, errPreconditionFailed)
+		return
+	}
+	r, spec, err := s.scheduleFrom(cur.User, p)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	cur.Task = r.Task
+	cur.Cron = r.Cron
+	cur.LifeTime = r.LifeTime
+	cur.Missed = r.Missed
+	cur.NextRun = spec.Next(time.Now())
+	err = update(s.orm, cur, cur.Id)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	s.expiry.Notify()
+	resp.AddHeader("ETag", etag(cur.Version))
+	resp.WriteEntity(scheduleGet(cur))
+}
+
+func (s *Server) DeleteUserSchedule(req *restful.Request, resp *restful.Response) {
+	r, err := s.userSchedule(req)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	_, err = s.orm.Delete(&models.Schedule{Id: r.Id})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	resp.WriteEntity(&GeneralResponse{Success: true})
+}
+
+func (s *Server) GetRoles(req *restful.Request, resp *restful.Response) {
+	roles := []*models.Role{}
+	err := s.orm.Asc("name").Find(&roles)
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	rslt := []*RoleGet{}
+	stored := map[string]bool{}
+	for _, r := range roles {
+		stored[r.Name] = true
+		users, err := s.orm.Count(&models.User{Role: r.Name})
+		if err != nil {
+			resp.WriteError(500, err)
+			return
+		}
+		rslt = append(rslt, roleGet(r, users))
+	}
+	for _, r := range models.BuiltinRoles {
+		if stored[r.Name] {
+			continue
+		}
+		users, err := s.orm.Count(&models.User{Role: r.Name})
+		if err != nil {
+			resp.WriteError(500, err)
+			return
+		}
+		rslt = append(rslt, roleGet(r, users))
+	}
+	resp.WriteEntity(rslt)
+}
+
+func (s *Server) GetRole(req *restful.Request, resp *restful.Response) {
+	r, ok, err := s.findRole(req.PathParameter("role"))
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	if !ok {
+		writeError(resp, errRoleNotFound)
+		return
+	}
+	users, err := s.orm.Count(&models.User{Role: r.Name})
+	if err != nil {
+		resp.WriteError(500, err)
+		return
+	}
+	resp.AddHeader("ETag", etag(r.Version))
+	resp.WriteEntity(roleGet(r, users))
+}
+
+// PutRole creates or replaces a role. Nobody may grant permissions it doesn't
+// have, nor take them from a role, and the admin role keeps all of them.
+func (s *Server) PutRole(req *restful.Request, resp *restful.Response) {
+	p := &RolePut{}
+	err := req.ReadEntity(p)
+	if err != nil || p.Name == "" {
+		resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "bad request"})
+		return
+	}
+	for _, perm := range p.Permissions {
+		known := false
+		for _, k := range models.Permissions {
+			known = known || k == perm
+		}
+		if !known {
+			resp.WriteHeaderAndEntity(400, &GeneralResponse{Success: false, Message: "unknown permission " + perm})
+			return
+		}
+	}
+	if p.Permissions == nil {
+		p.Permissions = []string{}
+	}
+	r := &models.Role{Name: p.Name, Permissions: p.Permissions, Description: p.Description}
+	if r.Name == "admin" && !r.Has(models.PermAll) {
+		resp.WriteHeaderAndEntity(409, &GeneralResponse{Success: false, Message: "the admin role keeps every permission"})
+		return
+	}
+	ifMatch := req.HeaderParameter("If-Match")
+	err = retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			cur := &models.Role{Name: p.Name}
+			exists, err := session.Get(cur)
+			if err != nil {
+				return nil, err
+			}
+			if ifMatch != "" && !(exists && matchETag(ifMatch, cur.Version)) {
+				return nil, errPreconditionFailed
+			}
+			roles := []*models.Role{r}
+			if exists {
+				roles = append(roles, cur)
+			} else if b := models.BuiltinRole(p.Name); b != nil {
+				roles = append(roles, b)
+			}
+			err = mayGrant(req, roles...)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				_, err = session.Insert(r)
+				return nil, err
+			}
+			r.Version = cur.Version
+			r.Creation = cur.Creation
+			return nil, update(session, r, r.Name)
+		})
+		return err
+	})
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.AddHeader("ETag", etag(r.Version))
+	resp.WriteEntity(&GeneralResponse{Success: true})
+}
+
+// DeleteRole deletes a role no user has. Builtin roles stay.
+func (s *Server) DeleteRole(req *restful.Request, resp *restful.Response) {
+	name := req.PathParameter("role")
+	if models.BuiltinRole(name) != nil {
+		resp.WriteHeaderAndEntity(409, &GeneralResponse{Success: false, Message: "builtin roles can't be deleted"})
+		return
+	}
+	_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+		r := &models.Role{Name: name}
+		ok, err := session.Get(r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errRoleNotFound
+		}
+		err = mayGrant(req, r)
+		if err != nil {
+			return nil, err
+		}
+		users, err := session.Count(&models.User{Role: name})
+		if err != nil {
+			return nil, err
+		}
+		if users > 0 {
+			return nil, newStatusError(409, fmt.Sprintf("%v users have the role", users))
+		}
+		_, err = session.Delete(&models.Role{Name: name})
+		return nil, err
+	})
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteEntity(&GeneralResponse{Success: true})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/utils/config"
+)
+
+func TestExtendTask(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  string
+		extra   time.Duration
+		quota   time.Duration // longest lifetime, 0 for none
+		reserve bool          // target 1 is reserved for bob after the task
+		code    int           // of the error, 0 for none
+		balance int
+	}{
+		{"extended", models.TaskActive, 30 * time.Minute, 0, false, 0, 200 - 2*2*30},
+		{"within the quota", models.TaskActive, 30 * time.Minute, 90 * time.Minute, false, 0, 200 - 2*2*30},
+		{"beyond the quota", models.TaskActive, 31 * time.Minute, 90 * time.Minute, false, 200, 200},
+		{"low balance", models.TaskActive, time.Hour, 0, false, 200, 200},
+		{"reserved", models.TaskActive, 30 * time.Minute, 0, true, 200, 200},
+		{"not active", models.TaskQueued, 30 * time.Minute, 0, false, 409, 200},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.conf.Quota.Default = &config.Quota{MaxLifeTime: c.quota}
+			task := running("t", 1, 10*time.Minute, false)
+			task.Status = c.status
+			task.Count = 2
+			task.TargetIDs = []int64{1, 2}
+			insert(t, s,
+				&models.User{Name: "alice", Balance: map[string]int{"CNY": 200}},
+				&models.InstanceType{Name: "x", Price: map[string]int{"CNY": 2}},
+				task,
+			)
+			if c.reserve {
+				insert(t, s, &models.Reservation{
+					InstanceType: "x",
+					Count:        1,
+					Start:        task.EndTime.Add(10 * time.Minute),
+					End:          task.EndTime.Add(time.Hour),
+					Users:        []string{"bob"},
+					Targets:      []int64{1},
+				})
+			}
+			got, err := s.extendTask("t", c.extra, "", "alice")
+			stored := getTask(t, s, "t")
+			if c.code != 0 {
+				if se, ok := err.(*statusError); !ok || se.status != c.code {
+					t.Errorf("got %v, want %v", err, c.code)
+				}
+				if !stored.EndTime.Equal(task.EndTime) || stored.LifeTime != task.LifeTime {
+					t.Errorf("stored %v for %v", stored.EndTime, stored.LifeTime)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := task.EndTime.Add(c.extra)
+				if !got.EndTime.Equal(want) || !stored.EndTime.Equal(want) || stored.LifeTime != task.LifeTime+c.extra {
+					t.Errorf("stored %v for %v, want %v", stored.EndTime, stored.LifeTime, want)
+				}
+				if evs := events(t, s, "t"); len(evs) != 1 || evs[0] != "active>active" {
+					t.Errorf("events %v", evs)
+				}
+			}
+			if b := balance(t, s, "alice"); b["CNY"] != c.balance {
+				t.Errorf("balance %v, want %v", b["CNY"], c.balance)
+			}
+		})
+	}
+}
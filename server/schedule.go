@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleFrom validates a schedule request of a user.
+func (s *Server) scheduleFrom(user string, p *SchedulePost) (*models.Schedule, cron.Schedule, error) {
+	spec, err := cron.ParseStandard(p.Cron)
+	if err != nil {
+		return nil, nil, newStatusError(200, "invalid cron expression: "+err.Error())
+	}
+	if spec.Next(time.Now()).IsZero() {
+		// robfig/cron gives up on dates that don't exist, like February 30
+		return nil, nil, newStatusError(200, "cron expression never fires")
+	}
+	lifetime, err := time.ParseDuration(p.LifeTime)
+	if err != nil {
+		return nil, nil, newStatusError(200, "invalid lifetime")
+	}
+	if lifetime < time.Minute {
+		return nil, nil, newStatusError(200, "life time too short")
+	}
+	missed := p.Missed
+	if missed == "" {
+		missed = models.ScheduleSkip
+	}
+	if missed != models.ScheduleSkip && missed != models.ScheduleCatchUp {
+		return nil, nil, newStatusError(200, "missed must be skip or catch-up")
+	}
+	t := &models.Task{Name: p.Task}
+	ok, err := s.orm.Get(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok || t.User != user {
+		return nil, nil, errTaskNotFound
+	}
+	return &models.Schedule{
+		User:     user,
+		Task:     p.Task,
+		Cron:     p.Cron,
+		LifeTime: lifetime,
+		Missed:   missed,
+	}, spec, nil
+}
+
+// runSchedules activates the tasks whose schedule fired and returns the next
+// time one fires, or the zero time when there are no schedules.
+func (s *Server) runSchedules() (time.Time, error) {
+	now := time.Now()
+	schedules := []*models.Schedule{}
+	err := s.orm.Where("next_run <= ?", now).Find(&schedules)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, found := range schedules {
+		err = s.runSchedule(found.Id, now)
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+	next := &models.Schedule{}
+	ok, err := s.orm.Asc("next_run").Get(next)
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return next.NextRun, nil
+}
+
+// runSchedule moves a due schedule to its next run and activates its task,
+// unless the run was missed and the schedule skips missed runs. Several missed
+// runs are caught up with a single activation, a task runs once at a time.
+func (s *Server) runSchedule(id int64, now time.Time) error {
+	var r *models.Schedule
+	run := false
+	err := retryOnConflict(func() error {
+		r = &models.Schedule{Id: id}
+		ok, err := s.orm.Get(r)
+		if err != nil || !ok || r.NextRun.After(now) {
+			return err
+		}
+		spec, err := cron.ParseStandard(r.Cron)
+		if err != nil {
+			return err
+		}
+		due := r.NextRun
+		r.NextRun = spec.Next(now)
+		run = now.Sub(due) <= s.conf.Schedule.MissedAfter || r.Missed == models.ScheduleCatchUp
+		if !run {
+			r.LastResult = "skipped the run missed at " + due.Format(time.RFC3339)
+		}
+		return update(s.orm, r, r.Id)
+	})
+	if err != nil || !run {
+		return err
+	}
+	status, err := s.requestActivation(r.Task, r.LifeTime, false, 0, "", systemActor)
+	result := status
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	log.Println("schedule", r.Id, "of task", r.Task, result)
+	return retryOnConflict(func() error {
+		cur := &models.Schedule{Id: r.Id}
+		ok, err := s.orm.Get(cur)
+		if err != nil || !ok {
+			return err
+		}
+		cur.LastRun = now
+		cur.LastResult = result
+		return update(s.orm, cur, cur.Id)
+	})
+}
+
+func scheduleGet(r *models.Schedule) *ScheduleGet {
+	return &ScheduleGet{
+		Id:         r.Id,
+		Task:       r.Task,
+		Cron:       r.Cron,
+		LifeTime:   r.LifeTime.String(),
+		Missed:     r.Missed,
+		NextRun:    r.NextRun,
+		LastRun:    r.LastRun,
+		LastResult: r.LastResult,
+		Creation:   r.Creation,
+	}
+}
@@ -1,26 +1,66 @@
 package server
 
 import (
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	restfulspec "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/scheduler"
 	"github.com/lcpu-dev/vmsched/utils/config"
+	"github.com/lcpu-dev/vmsched/utils/directory"
+	"github.com/lcpu-dev/vmsched/utils/oidc"
 	lxd "github.com/lxc/lxd/client"
 	"xorm.io/xorm"
 )
 
 type Server struct {
-	orm  *xorm.Engine
-	lxd  lxd.InstanceServer
-	conf *config.Configure
+	orm    *xorm.Engine
+	lxd    lxd.InstanceServer
+	conf   *config.Configure
+	expiry *expiry
+	leader *leader
+	sched  scheduler.Scheduler
+	idle   *idleTracker
+	oidc   *oidc.Provider       // nil unless logging in through OIDC is configured
+	dir    *directory.Directory // nil unless LDAP is configured
+
+	ldapLogins *ldapLogins
+	verified   *verifiedTokens
+	reconciled time.Time
+	ldapSynced time.Time
 }
 
 func NewServer(conf *config.Configure) (*Server, error) {
 	s := new(Server)
 	s.conf = conf
+	sched, err := scheduler.Get(conf.Queue.Policy)
+	if err != nil {
+		return nil, err
+	}
+	s.sched = sched
+	if o := conf.OIDC; o.Issuer != "" {
+		if o.ClientID == "" || o.ClientSecret == "" || o.RedirectURL == "" {
+			return nil, errors.New("oidc needs a client id, a client secret and a redirect url")
+		}
+		s.oidc = &oidc.Provider{
+			Issuer:       o.Issuer,
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			RedirectURL:  o.RedirectURL,
+			Scopes:       o.Scopes,
+			Client:       &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	if conf.LDAP.URL != "" {
+		s.dir = directory.New(conf.LDAP)
+	}
+	s.ldapLogins = newLDAPLogins()
+	s.verified = newVerifiedTokens()
 	orm, err := xorm.NewEngine(conf.Database.Driver, conf.Database.DSN)
 	if err != nil {
 		return nil, err
@@ -36,117 +76,65 @@ func NewServer(conf *config.Configure) (*Server, error) {
 		return nil, err
 	}
 	s.lxd = ls
+	s.expiry = newExpiry(s)
+	s.idle = newIdleTracker()
+	s.leader, err = newLeader(s, cronLease)
+	if err != nil {
+		orm.Close()
+		return nil, err
+	}
 	return s, nil
 }
 
-// returns an empty string when auth failure
-func (s *Server) credentialToUser(tokenName string, secret string) string {
+// tokenUseResolution is how stale the last use of a token may get, so that
+// not every request writes to the database.
+const tokenUseResolution = time.Minute
+
+// credentialToToken returns the token a secret belongs to, or nil if it is
+// wrong or expired, and records the use from ip. When LDAP is configured, a
+// directory user name and password are taken as well, for names no token has.
+func (s *Server) credentialToToken(tokenName string, secret string, ip string) *models.Token {
 	t := &models.Token{Name: tokenName}
 	ok, err := s.orm.Get(t)
 	if err != nil {
 		log.Println("ERROR:", err)
-		return ""
+		return nil
 	}
 	if !ok {
-		return ""
-	}
-	if t.Secret != secret {
-		return ""
-	}
-	return t.User
-}
-
-func (s *Server) userHaveAccessTo(user string, minRole string, task string, instance string, requiredUser string) bool {
-	if user == "" {
-		return false
-	}
-	u := &models.User{Name: user}
-	ok, err := s.orm.Get(u)
-	if err != nil {
-		log.Println("ERROR:", err)
-		return false
+		return s.directoryLogin(tokenName, secret, ip)
 	}
-	if !ok {
-		return false
+	if !models.SecretHashed(t.Secret) {
+		log.Println("token", t.Name, "is not hashed, run migrate-tokens")
+		return nil
 	}
-	if minRole != "" {
-		if u.Role == "admin" {
-			return true
-		}
-		if minRole == "admin" {
-			return false
-		}
-		if minRole == "user" && u.Role == "banned" {
-			return false
+	if !s.verified.valid(t.Name, t.Secret, secret) {
+		if !models.VerifySecret(t.Secret, secret) {
+			return nil
 		}
+		s.verified.remember(t.Name, t.Secret, secret)
 	}
-	if task != "" {
-		t := &models.Task{Name: task}
-		ok, err := s.orm.Get(t)
-		if err != nil {
-			log.Println("ERROR:", err)
-			return false
-		}
-		if !ok {
-			return false
-		}
-		if t.User != u.Name {
-			return false
-		}
+	now := time.Now()
+	if t.Expired(now) {
+		return nil
 	}
-	if instance != "" {
-		t := &models.Task{Instance: instance}
-		ok, err := s.orm.Get(t)
+	if now.Sub(t.LastUsed) >= tokenUseResolution || t.LastIP != ip {
+		t.LastUsed = now
+		t.LastIP = ip
+		_, err = s.orm.Cols("last_used", "last_ip").Update(t, &models.Token{Name: t.Name})
 		if err != nil {
 			log.Println("ERROR:", err)
-			return false
-		}
-		if !ok {
-			return false
-		}
-		if t.User != u.Name {
-			return false
-		}
-		if t.Status != "active" {
-			return false
 		}
 	}
-	if requiredUser != "" {
-		if requiredUser != user {
-			return false
-		}
-	}
-	return true
+	return t
 }
 
-func (s *Server) filterAuth(minRole string) restful.FilterFunction {
-	return func(req *restful.Request, resp *restful.Response, fc *restful.FilterChain) {
-		ins, ok := req.PathParameters()["instance"]
-		if !ok {
-			ins = ""
-		}
-		task, ok := req.PathParameters()["task"]
-		if !ok {
-			task = ""
-		}
-		tokenName := req.HeaderParameter("X-Token-Name")
-		tokenSecret := req.HeaderParameter("X-Token-Secret")
-		if tokenName == "" {
-			tokenName = req.QueryParameter("token-name")
-			tokenSecret = req.QueryParameter("token-secret")
-		}
-		user, ok := req.PathParameters()["user"]
-		if !ok {
-			user = ""
-		}
-		u := s.credentialToUser(tokenName, tokenSecret)
-		req.SetAttribute("user", u)
-		if s.userHaveAccessTo(u, minRole, task, ins, user) {
-			fc.ProcessFilter(req, resp)
-		} else {
-			resp.WriteErrorString(403, "Access Denied")
-		}
+// remoteIP returns the address a request comes from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
 }
 
 func (s *Server) Run() error {
@@ -156,28 +144,32 @@ func (s *Server) Run() error {
 	ws.Path("/api/v1").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
 	ws.Filter(func(r1 *restful.Request, r2 *restful.Response, fc *restful.FilterChain) {
 		r2.AddHeader("Access-Control-Allow-Origin", "*")
+		r2.AddHeader("Access-Control-Expose-Headers", "ETag")
 		fc.ProcessFilter(r1, r2)
 	})
 	ws.Route(
 		ws.PUT("/user").
 			Reads(UserPut{}).
-			Filter(s.filterAuth("admin")).
+			Filter(s.filterAuth(only(models.PermManageUsers), models.ScopeAdmin)).
 			Returns(200, "OK", GeneralResponse{}).
+			Returns(403, "Forbidden", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(412, "Precondition Failed", GeneralResponse{}).
 			Returns(500, "Internal Server Error", GeneralResponse{}).
 			To(s.PutUser),
 	)
 	ws.Route(
 		ws.GET("/user").
-			Filter(s.filterAuth("banned")).
-			Returns(200, "OK", UserPut{}).
+			Filter(s.filterAuth(everyone, models.ScopeTaskRead)).
+			Returns(200, "OK", UserGet{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.GetUser),
 	)
 	ws.Route(
 		ws.GET("/user/{user}").
 			Param(restful.PathParameter("user", "username")).
-			Filter(s.filterAuth("admin")).
-			Returns(200, "OK", UserPut{}).
+			Filter(s.filterAuth(only(models.PermManageUsers), models.ScopeAdmin)).
+			Returns(200, "OK", UserGet{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.GetUser),
 	)
@@ -185,16 +177,18 @@ func (s *Server) Run() error {
 		ws.PUT("/user/{user}/token").
 			Param(restful.PathParameter("user", "username")).
 			Reads(TokenPut{}).
-			Filter(s.filterAuth("user")).
-			Returns(200, "OK", GeneralResponse{}).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageUsers), models.ScopeToken)).
+			Returns(200, "OK", TokenSecretGet{}).
+			Returns(403, "Forbidden", GeneralResponse{}).
 			Returns(404, "User Not Found", nil).
+			Returns(409, "Conflict", nil).
 			Returns(500, "Internal Server Error", nil).
 			To(s.PutUserToken),
 	)
 	ws.Route(
 		ws.GET("/user/{user}/token").
 			Param(restful.PathParameter("user", "username")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageUsers), models.ScopeToken)).
 			Returns(200, "OK", TokenGet{}).
 			Returns(404, "User Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
@@ -204,16 +198,40 @@ func (s *Server) Run() error {
 		ws.DELETE("/user/{user}/token/{token}").
 			Param(restful.PathParameter("user", "username")).
 			Param(restful.PathParameter("token", "token name")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageUsers), models.ScopeToken)).
 			Returns(200, "OK", GeneralResponse{}).
+			Returns(403, "Forbidden", GeneralResponse{}).
 			Returns(404, "Not Found", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.DeleteUserToken),
 	)
+	ws.Route(
+		ws.GET("/user/{user}/transactions").
+			Param(restful.PathParameter("user", "username")).
+			Param(restful.QueryParameter("from", "only transactions at or after this RFC3339 time")).
+			Param(restful.QueryParameter("to", "only transactions before this RFC3339 time")).
+			Param(restful.QueryParameter("currency", "only transactions in this currency")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermTopUp), models.ScopeTaskRead)).
+			Returns(200, "OK", []TransactionGet{}).
+			Returns(400, "Bad Request", nil).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetUserTransactions),
+	)
+	ws.Route(
+		ws.POST("/user/{user}/transactions").
+			Param(restful.PathParameter("user", "username")).
+			Reads(TransactionPost{}).
+			Filter(s.filterAuth(only(models.PermTopUp), models.ScopeAdmin)).
+			Returns(200, "OK", GeneralResponse{}).
+			Returns(400, "Bad Request", GeneralResponse{}).
+			Returns(404, "User Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.PostUserTransaction),
+	)
 	ws.Route(
 		ws.GET("/user/{user}/task").
 			Param(restful.PathParameter("user", "username")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
 			Returns(200, "OK", []TaskGet{}).
 			Returns(404, "User Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
@@ -223,27 +241,107 @@ func (s *Server) Run() error {
 		ws.POST("/user/{user}/task").
 			Param(restful.PathParameter("user", "username")).
 			Reads(TaskPost{}).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(404, "Not Found", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.PostUserTask),
 	)
+	ws.Route(
+		ws.GET("/user/{user}/schedule").
+			Param(restful.PathParameter("user", "username")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
+			Returns(200, "OK", []ScheduleGet{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetUserSchedules),
+	)
+	ws.Route(
+		ws.POST("/user/{user}/schedule").
+			Param(restful.PathParameter("user", "username")).
+			Reads(SchedulePost{}).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
+			Returns(200, "OK", ScheduleGet{}).
+			Returns(404, "Task Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.PostUserSchedule),
+	)
+	ws.Route(
+		ws.GET("/user/{user}/schedule/{schedule}").
+			Param(restful.PathParameter("user", "username")).
+			Param(restful.PathParameter("schedule", "schedule id")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
+			Returns(200, "OK", ScheduleGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetUserSchedule),
+	)
+	ws.Route(
+		ws.PUT("/user/{user}/schedule/{schedule}").
+			Param(restful.PathParameter("user", "username")).
+			Param(restful.PathParameter("schedule", "schedule id")).
+			Reads(SchedulePost{}).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
+			Returns(200, "OK", ScheduleGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(412, "Precondition Failed", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.PutUserSchedule),
+	)
+	ws.Route(
+		ws.DELETE("/user/{user}/schedule/{schedule}").
+			Param(restful.PathParameter("user", "username")).
+			Param(restful.PathParameter("schedule", "schedule id")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
+			Returns(200, "OK", GeneralResponse{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.DeleteUserSchedule),
+	)
 	ws.Route(
 		ws.GET("/task/{task}").
 			Param(restful.PathParameter("task", "task name")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
 			Returns(200, "OK", TaskGet{}).
 			Returns(404, "Task Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
 			To(s.GetTask),
 	)
+	ws.Route(
+		ws.GET("/task/{task}/queue").
+			Param(restful.PathParameter("task", "task name")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
+			Returns(200, "OK", TaskQueueGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetTaskQueue),
+	)
+	ws.Route(
+		ws.GET("/task/{task}/pipeline").
+			Param(restful.PathParameter("task", "task name")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
+			Returns(200, "OK", []PipelineTaskGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetTaskPipeline),
+	)
+	ws.Route(
+		ws.GET("/task/{task}/events").
+			Param(restful.PathParameter("task", "task name")).
+			Filter(s.filterAuth(historyOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
+			Returns(200, "OK", []TaskEventGet{}).
+			Returns(404, "Task Not Found", nil).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetTaskEvents),
+	)
 	ws.Route(
 		ws.DELETE("/task/{task}").
 			Param(restful.PathParameter("task", "task name")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(412, "Precondition Failed", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.DeleteTask),
 	)
@@ -251,16 +349,18 @@ func (s *Server) Run() error {
 		ws.POST("/task/{task}/state").
 			Param(restful.PathParameter("task", "task name")).
 			Reads(TaskStatePost{}).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(412, "Precondition Failed", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.PostTaskState),
 	)
 	ws.Route(
 		ws.GET("/instance/{instance}/state").
 			Param(restful.PathParameter("instance", "instance name")).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermViewTasks), models.ScopeTaskRead)).
 			Returns(200, "OK", InstanceStateGet{}).
 			Returns(404, "Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
@@ -270,7 +370,7 @@ func (s *Server) Run() error {
 		ws.PUT("/instance/{instance}/state").
 			Param(restful.PathParameter("instance", "instance name")).
 			Reads(InstanceStatePut{}).
-			Filter(s.filterAuth("user")).
+			Filter(s.filterAuth(ownOr(models.PermUse, models.PermManageTasks), models.ScopeTaskWrite)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(404, "Not Found", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
@@ -280,7 +380,7 @@ func (s *Server) Run() error {
 		ws.GET("/instance-type/{type}/queue-time").
 			Param(restful.PathParameter("type", "instance type name")).
 			Param(restful.QueryParameter("time", "observation time")).
-			Filter(s.filterAuth("banned")).
+			Filter(s.filterAuth(everyone, models.ScopeTaskRead)).
 			Returns(200, "OK", QueueTimeGet{}).
 			Returns(404, "Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
@@ -288,7 +388,7 @@ func (s *Server) Run() error {
 	)
 	ws.Route(
 		ws.GET("/instance-type").
-			Filter(s.filterAuth("banned")).
+			Filter(s.filterAuth(everyone, models.ScopeTaskRead)).
 			Returns(200, "OK", InstanceTypeGet{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.GetInstanceTypes),
@@ -296,7 +396,7 @@ func (s *Server) Run() error {
 	ws.Route(
 		ws.GET("/instance-type/{type}").
 			Param(restful.PathParameter("type", "instance type name")).
-			Filter(s.filterAuth("banned")).
+			Filter(s.filterAuth(everyone, models.ScopeTaskRead)).
 			Returns(200, "OK", []InstanceTypeGet{}).
 			Returns(404, "Not Found", nil).
 			Returns(500, "Internal Server Error", nil).
@@ -305,7 +405,7 @@ func (s *Server) Run() error {
 	ws.Route(
 		ws.PUT("/instance-type").
 			Reads(InstanceTypePut{}).
-			Filter(s.filterAuth("admin")).
+			Filter(s.filterAuth(only(models.PermManageInstanceTypes), models.ScopeAdmin)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.PutInstanceType),
@@ -313,11 +413,114 @@ func (s *Server) Run() error {
 	ws.Route(
 		ws.DELETE("/instance-type/{type}").
 			Param(restful.PathParameter("type", "instance type name")).
-			Filter(s.filterAuth("admin")).
+			Filter(s.filterAuth(only(models.PermManageInstanceTypes), models.ScopeAdmin)).
 			Returns(200, "OK", GeneralResponse{}).
 			Returns(500, "Internal Server Error", nil).
 			To(s.DeleteInstanceType),
 	)
+	ws.Route(
+		ws.GET("/lease").
+			Filter(s.filterAuth(only(models.PermViewLease), models.ScopeAdmin)).
+			Returns(200, "OK", LeaseGet{}).
+			Returns(404, "Not Found", nil).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetLease),
+	)
+	ws.Route(
+		ws.POST("/reservation").
+			Reads(ReservationPost{}).
+			Filter(s.filterAuth(only(models.PermManageReservations), models.ScopeAdmin)).
+			Returns(200, "OK", ReservationGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.PostReservation),
+	)
+	ws.Route(
+		ws.GET("/reservation").
+			Filter(s.filterAuth(only(models.PermManageReservations), models.ScopeAdmin)).
+			Returns(200, "OK", []ReservationGet{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetReservations),
+	)
+	ws.Route(
+		ws.GET("/reservation/{reservation}").
+			Param(restful.PathParameter("reservation", "reservation id")).
+			Filter(s.filterAuth(only(models.PermManageReservations), models.ScopeAdmin)).
+			Returns(200, "OK", ReservationGet{}).
+			Returns(404, "Not Found", nil).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetReservation),
+	)
+	ws.Route(
+		ws.DELETE("/reservation/{reservation}").
+			Param(restful.PathParameter("reservation", "reservation id")).
+			Filter(s.filterAuth(only(models.PermManageReservations), models.ScopeAdmin)).
+			Returns(200, "OK", GeneralResponse{}).
+			Returns(404, "Not Found", nil).
+			Returns(500, "Internal Server Error", nil).
+			To(s.DeleteReservation),
+	)
+	ws.Route(
+		ws.GET("/role").
+			Filter(s.filterAuth(only(models.PermManageRoles), models.ScopeAdmin)).
+			Returns(200, "OK", []RoleGet{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetRoles),
+	)
+	ws.Route(
+		ws.GET("/role/{role}").
+			Param(restful.PathParameter("role", "role name")).
+			Filter(s.filterAuth(only(models.PermManageRoles), models.ScopeAdmin)).
+			Returns(200, "OK", RoleGet{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(500, "Internal Server Error", nil).
+			To(s.GetRole),
+	)
+	ws.Route(
+		ws.PUT("/role").
+			Reads(RolePut{}).
+			Filter(s.filterAuth(only(models.PermManageRoles), models.ScopeAdmin)).
+			Returns(200, "OK", GeneralResponse{}).
+			Returns(400, "Bad Request", GeneralResponse{}).
+			Returns(403, "Forbidden", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(412, "Precondition Failed", GeneralResponse{}).
+			Returns(500, "Internal Server Error", GeneralResponse{}).
+			To(s.PutRole),
+	)
+	ws.Route(
+		ws.DELETE("/role/{role}").
+			Param(restful.PathParameter("role", "role name")).
+			Filter(s.filterAuth(only(models.PermManageRoles), models.ScopeAdmin)).
+			Returns(200, "OK", GeneralResponse{}).
+			Returns(403, "Forbidden", GeneralResponse{}).
+			Returns(404, "Not Found", GeneralResponse{}).
+			Returns(409, "Conflict", GeneralResponse{}).
+			Returns(500, "Internal Server Error", GeneralResponse{}).
+			To(s.DeleteRole),
+	)
+
+	if s.oidc != nil {
+		ws.Route(
+			ws.GET("/oidc/login").
+				Param(restful.QueryParameter("redirect", "where to send the session token, it is shown when empty")).
+				Returns(302, "Found", nil).
+				Returns(400, "Bad Request", GeneralResponse{}).
+				Returns(502, "Bad Gateway", GeneralResponse{}).
+				To(s.GetOIDCLogin),
+		)
+		ws.Route(
+			ws.GET("/oidc/callback").
+				Param(restful.QueryParameter("code", "authorization code")).
+				Param(restful.QueryParameter("state", "login state")).
+				Returns(200, "OK", TokenSecretGet{}).
+				Returns(302, "Found", nil).
+				Returns(400, "Bad Request", GeneralResponse{}).
+				Returns(401, "Unauthorized", GeneralResponse{}).
+				Returns(500, "Internal Server Error", nil).
+				To(s.GetOIDCCallback),
+		)
+	}
 
 	rc := restful.NewContainer()
 	rc.ServeMux = mux
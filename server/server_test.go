@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+	"github.com/lcpu-dev/vmsched/scheduler"
+	"github.com/lcpu-dev/vmsched/utils/config"
+	lxd "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	_ "github.com/mattn/go-sqlite3"
+	"xorm.io/xorm"
+)
+
+var now = time.Now().Truncate(time.Second)
+
+// fakeLXD records the instances stopped, they are all stopped already, and
+// reports the state set for an instance. Any other call panics.
+type fakeLXD struct {
+	lxd.InstanceServer
+	stopped []string
+	states  map[string]*api.InstanceState
+}
+
+func (f *fakeLXD) GetInstanceState(name string) (*api.InstanceState, string, error) {
+	state, ok := f.states[name]
+	if !ok {
+		return nil, "", errors.New("Instance not found")
+	}
+	return state, "", nil
+}
+
+func (f *fakeLXD) UpdateInstanceState(name string, state api.InstanceStatePut, ETag string) (lxd.Operation, error) {
+	f.stopped = append(f.stopped, name)
+	return nil, errors.New("The instance is already stopped")
+}
+
+// newTestServer returns a server with the default configuration on an empty
+// in-memory database. It doesn't hold the cron lease.
+func newTestServer(t *testing.T) (*Server, *fakeLXD) {
+	path := filepath.Join(t.TempDir(), "vmsched.yml")
+	err := os.WriteFile(path, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.LoadConfigure(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm, err := xorm.NewEngine("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { orm.Close() })
+	// every connection would open a database of its own
+	orm.SetMaxOpenConns(1)
+	err = models.Sync(orm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched, err := scheduler.Get(conf.Queue.Policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeLXD{states: map[string]*api.InstanceState{}}
+	s := &Server{
+		orm:        orm,
+		lxd:        fake,
+		conf:       conf,
+		sched:      sched,
+		idle:       newIdleTracker(),
+		ldapLogins: newLDAPLogins(),
+		verified:   newVerifiedTokens(),
+	}
+	s.expiry = newExpiry(s)
+	s.leader, err = newLeader(s, cronLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func insert(t *testing.T, s *Server, beans ...interface{}) {
+	t.Helper()
+	for _, b := range beans {
+		if _, err := s.orm.Insert(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// getTask reads a task back from the database.
+func getTask(t *testing.T, s *Server, name string) *models.Task {
+	t.Helper()
+	task := &models.Task{Name: name}
+	ok, err := s.orm.Get(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("task %v not found", name)
+	}
+	return task
+}
+
+// running returns a task of alice active on target since ago, for an hour.
+func running(name string, target int64, ago time.Duration, preemptible bool) *models.Task {
+	return &models.Task{
+		Name:         name,
+		InstanceType: "x",
+		User:         "alice",
+		Status:       models.TaskActive,
+		QueueTime:    now.Add(-ago - time.Second),
+		ActiveTime:   now.Add(-ago),
+		EndTime:      now.Add(-ago + time.Hour),
+		LifeTime:     time.Hour,
+		Price:        map[string]int{"CNY": 1},
+		TargetID:     target,
+		Instance:     name + "-0",
+		Preemptible:  preemptible,
+	}
+}
+
+// balance reads the balance of a user back from the database.
+func balance(t *testing.T, s *Server, user string) map[string]int {
+	t.Helper()
+	u := &models.User{Name: user}
+	ok, err := s.orm.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("user %v not found", user)
+	}
+	return u.Balance
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/lcpu-dev/vmsched/models"
+	"xorm.io/xorm"
+)
+
+// systemActor is recorded for transitions not requested by a user.
+const systemActor = "system"
+
+func actorOf(req *restful.Request) string {
+	if u, ok := req.Attribute("user").(string); ok && u != "" {
+		return u
+	}
+	return systemActor
+}
+
+func errIllegalTransition(from string, to string) error {
+	if from == "" {
+		return newStatusError(409, fmt.Sprintf("task cannot become %v", to))
+	}
+	return newStatusError(409, fmt.Sprintf("task is %v, it cannot become %v", from, to))
+}
+
+// transitTask moves a task to another status and records the change in its
+// history. Other fields changed by the caller are written along with the
+// status: the row is inserted when coming from "" and removed when going to
+// models.TaskDeleted.
+func (s *Server) transitTask(db xorm.Interface, task *models.Task, to string, actor string, reason string) error {
+	if e, ok := db.(*xorm.Engine); ok {
+		// the status and its event are written together or not at all
+		orig := *task
+		_, err := e.Transaction(func(session *xorm.Session) (interface{}, error) {
+			return nil, s.transitTask(session, task, to, actor, reason)
+		})
+		if err != nil {
+			*task = orig
+		}
+		return err
+	}
+	from := task.Status
+	if !models.TaskStates.CanTransit(from, to) {
+		return errIllegalTransition(from, to)
+	}
+	task.Status = to
+	var err error
+	switch {
+	case from == "":
+		_, err = db.Insert(task)
+	case to == models.TaskDeleted:
+		_, err = db.Delete(&models.Task{Name: task.Name})
+	default:
+		err = update(db, task, task.Name)
+	}
+	if err != nil {
+		task.Status = from
+		return err
+	}
+	return s.recordTaskEvent(db, task, from, to, actor, reason)
+}
+
+// recordTaskEvent adds an entry to the history of a task, transitTask does so
+// for every status change.
+func (s *Server) recordTaskEvent(db xorm.Interface, task *models.Task, from string, to string, actor string, reason string) error {
+	_, err := db.Insert(&models.TaskEvent{
+		Task:   task.Name,
+		User:   task.User,
+		Actor:  actor,
+		From:   from,
+		To:     to,
+		Reason: reason,
+	})
+	return err
+}
+
+// deactivateTask moves a queued or terminating task back to inactive and, in
+// the same transaction, refunds the unused part of its activation and records
+// what it used. Doing all at once makes sure every activation is settled once.
+func (s *Server) deactivateTask(task *models.Task, actor string, reason string) error {
+	return retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			t := &models.Task{Name: task.Name}
+			ok, err := session.Get(t)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errTaskNotFound
+			}
+			ran := t.Status == models.TaskTerminating && !t.ActiveTime.IsZero() && !t.ActiveTime.Before(t.QueueTime)
+			err = s.transitTask(session, t, models.TaskInactive, actor, reason)
+			if err != nil {
+				return nil, err
+			}
+			*task = *t
+			if ran {
+				_, err = session.Insert(&models.Usage{
+					User:         t.User,
+					Task:         t.Name,
+					InstanceType: t.InstanceType,
+					Count:        t.Size(),
+					Start:        t.ActiveTime,
+					End:          time.Now(),
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, s.refundUnused(session, t, actor)
+		})
+		return err
+	})
+}
+
+// cancelTask takes a queued task out of the queue and refunds it, or stops a
+// held task from waiting. The queue entry has to be removed by us: if the
+// dispatcher got it first, the task is being activated and can't be cancelled
+// any more.
+func (s *Server) cancelTask(name string, ifMatch string, actor string) error {
+	return retryOnConflict(func() error {
+		_, err := s.orm.Transaction(func(session *xorm.Session) (interface{}, error) {
+			t := &models.Task{Name: name}
+			ok, err := session.Get(t)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errTaskNotFound
+			}
+			if !matchETag(ifMatch, t.Version) {
+				return nil, errPreconditionFailed
+			}
+			if t.Status == models.TaskHeld {
+				// nothing was paid or queued yet
+				return nil, s.transitTask(session, t, models.TaskInactive, actor, "cancelled")
+			}
+			if t.Status != models.TaskQueued {
+				return nil, errIllegalTransition(t.Status, models.TaskInactive)
+			}
+			affectedRows, err := session.Delete(&models.Queue{Task: t.Name})
+			if err != nil {
+				return nil, err
+			}
+			if affectedRows <= 0 {
+				return nil, newStatusError(409, "task is being activated")
+			}
+			err = s.transitTask(session, t, models.TaskInactive, actor, "cancelled")
+			if err != nil {
+				return nil, err
+			}
+			return nil, s.refundUnused(session, t, actor)
+		})
+		return err
+	})
+}
+
+// taskOfInstance finds the task an instance belongs to, whether it is the
+// first instance of its group or not.
+func (s *Server) taskOfInstance(instance string) (*models.Task, bool, error) {
+	t := &models.Task{Instance: instance}
+	ok, err := s.orm.Get(t)
+	if err != nil || ok {
+		return t, ok, err
+	}
+	tasks := []*models.Task{}
+	err = s.orm.Where("instances LIKE ?", "%"+strconv.Quote(instance)+"%").Find(&tasks)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, t := range tasks {
+		for _, ins := range t.Instances {
+			if ins == instance {
+				return t, true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcpu-dev/vmsched/models"
+)
+
+// events returns the statuses a task went through, one "from>to" per event.
+func events(t *testing.T, s *Server, task string) []string {
+	t.Helper()
+	evs := []*models.TaskEvent{}
+	err := s.orm.Asc("id").Find(&evs, &models.TaskEvent{Task: task})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rslt := []string{}
+	for _, e := range evs {
+		rslt = append(rslt, e.From+">"+e.To)
+	}
+	return rslt
+}
+
+func TestTransitTask(t *testing.T) {
+	cases := []struct {
+		from string
+		to   string
+		ok   bool
+	}{
+		{"", models.TaskCreating, true},
+		{"", models.TaskInactive, false},
+		{models.TaskCreating, models.TaskInactive, true},
+		{models.TaskInactive, models.TaskActive, false},
+		{models.TaskQueued, models.TaskActive, true},
+		{models.TaskActive, models.TaskInactive, false},
+		{models.TaskActive, models.TaskTerminating, true},
+		{models.TaskDeleting, models.TaskDeleted, true},
+		{models.TaskDeleting, models.TaskInactive, false},
+	}
+	for _, c := range cases {
+		s, _ := newTestServer(t)
+		task := &models.Task{Name: "t", InstanceType: "x", User: "alice", Status: c.from, Preemptible: true}
+		if c.from != "" {
+			insert(t, s, task)
+		}
+		// fields changed by the caller are written along, zero values too
+		task.Preemptible = false
+		err := s.transitTask(s.orm, task, c.to, "bob", "testing")
+		if !c.ok {
+			if se, ok := err.(*statusError); !ok || se.status != 409 {
+				t.Errorf("%q to %q: %v", c.from, c.to, err)
+			}
+			if task.Status != c.from || len(events(t, s, "t")) != 0 {
+				t.Errorf("%q to %q: left %v with events %v", c.from, c.to, task.Status, events(t, s, "t"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q to %q: %v", c.from, c.to, err)
+			continue
+		}
+		if evs := events(t, s, "t"); len(evs) != 1 || evs[0] != c.from+">"+c.to {
+			t.Errorf("%q to %q: events %v", c.from, c.to, evs)
+		}
+		if c.to == models.TaskDeleted {
+			if ok, err := s.orm.Exist(&models.Task{Name: "t"}); err != nil || ok {
+				t.Errorf("%q to %q: row kept", c.from, c.to)
+			}
+			continue
+		}
+		got := getTask(t, s, "t")
+		if got.Status != c.to || got.Preemptible {
+			t.Errorf("%q to %q: stored %+v", c.from, c.to, got)
+		}
+	}
+}
+
+func TestTransitTaskConflict(t *testing.T) {
+	s, _ := newTestServer(t)
+	insert(t, s, &models.Task{Name: "t", InstanceType: "x", User: "alice", Status: models.TaskQueued})
+	first := getTask(t, s, "t")
+	stale := getTask(t, s, "t")
+	if err := s.transitTask(s.orm, first, models.TaskInactive, "alice", "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	orig := *stale
+	stale.LifeTime = time.Hour
+	err := s.transitTask(s.orm, stale, models.TaskActive, systemActor, "activated")
+	if err != errConflict {
+		t.Errorf("stale task: %v", err)
+	}
+	// the task is as read, the transaction rolled back
+	if stale.Status != orig.Status || stale.Version != orig.Version || stale.LifeTime != time.Hour {
+		t.Errorf("stale task left as %+v", stale)
+	}
+	if got := getTask(t, s, "t"); got.Status != models.TaskInactive {
+		t.Errorf("stored %v", got.Status)
+	}
+	if evs := events(t, s, "t"); len(evs) != 1 {
+		t.Errorf("events %v", evs)
+	}
+}
+
+func TestDeactivateTask(t *testing.T) {
+	cases := []struct {
+		name    string
+		ago     time.Duration // since the activation started, 0 if it didn't
+		refund  int
+		usage   bool
+		minutes time.Duration
+	}{
+		// every started minute is used
+		{"ran a while", 10*time.Minute + 30*time.Second, 2 * 49, true, 11 * time.Minute},
+		{"ran out", 2 * time.Hour, 0, true, 2 * time.Hour},
+		{"never started", 0, 2 * 60, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			task := &models.Task{
+				Name:         "t",
+				InstanceType: "x",
+				User:         "alice",
+				Status:       models.TaskTerminating,
+				QueueTime:    now.Add(-3 * time.Hour),
+				LifeTime:     time.Hour,
+				Price:        map[string]int{"CNY": 2},
+			}
+			if c.ago != 0 {
+				task.ActiveTime = now.Add(-c.ago)
+			}
+			insert(t, s, &models.User{Name: "alice", Balance: map[string]int{"CNY": 0}}, task)
+			err := s.deactivateTask(task, systemActor, "instance stopped")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if task.Status != models.TaskInactive || getTask(t, s, "t").Status != models.TaskInactive {
+				t.Errorf("task left %v", task.Status)
+			}
+			if b := balance(t, s, "alice"); b["CNY"] != c.refund {
+				t.Errorf("refunded %v, want %v", b["CNY"], c.refund)
+			}
+			usage := []*models.Usage{}
+			if err := s.orm.Find(&usage); err != nil {
+				t.Fatal(err)
+			}
+			if !c.usage {
+				if len(usage) != 0 {
+					t.Errorf("usage recorded %+v", usage[0])
+				}
+				return
+			}
+			if len(usage) != 1 || usage[0].Count != 1 || !usage[0].Start.Equal(task.ActiveTime) {
+				t.Fatalf("usage %+v", usage)
+			}
+			if d := usage[0].End.Sub(usage[0].Start); d < c.ago || d > c.ago+time.Minute {
+				t.Errorf("used %v, want %v", d, c.ago)
+			}
+		})
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  string
+		queued  bool // the queue row is still there
+		ifMatch string
+		code    int // of the error, 0 for none
+		refund  int
+	}{
+		{"queued", models.TaskQueued, true, "", 0, 2 * 60},
+		{"queued, matching version", models.TaskQueued, true, etag(1), 0, 2 * 60},
+		{"queued, other version", models.TaskQueued, true, etag(2), 412, 0},
+		{"being activated", models.TaskQueued, false, "", 409, 0},
+		{"held", models.TaskHeld, false, "", 0, 0},
+		{"active", models.TaskActive, false, "", 409, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			insert(t, s,
+				&models.User{Name: "alice", Balance: map[string]int{"CNY": 0}},
+				&models.Task{
+					Name:         "t",
+					InstanceType: "x",
+					User:         "alice",
+					Status:       c.status,
+					QueueTime:    now.Add(-time.Minute),
+					LifeTime:     time.Hour,
+					Price:        map[string]int{"CNY": 2},
+				},
+			)
+			if c.queued {
+				insert(t, s, &models.Queue{User: "alice", Task: "t", InstanceType: "x", LifeTime: time.Hour, Count: 1})
+			}
+			err := s.cancelTask("t", c.ifMatch, "alice")
+			if c.code != 0 {
+				if se, ok := err.(*statusError); !ok || se.status != c.code {
+					t.Errorf("got %v, want %v", err, c.code)
+				}
+				if got := getTask(t, s, "t").Status; got != c.status {
+					t.Errorf("task left %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := getTask(t, s, "t").Status; got != models.TaskInactive {
+					t.Errorf("task left %v", got)
+				}
+				if n, err := s.orm.Count(&models.Queue{}); err != nil || n != 0 {
+					t.Errorf("%v queue rows left", n)
+				}
+			}
+			if b := balance(t, s, "alice"); b["CNY"] != c.refund {
+				t.Errorf("refunded %v, want %v", b["CNY"], c.refund)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+	"time"
+)
+
+// tokenVerifyTTL is how long a verified token secret is trusted without
+// hashing it again, argon2 is slow on purpose and WebDAV clients send the
+// secret with every request.
+const tokenVerifyTTL = time.Minute
+
+// verifiedTokens remembers the secrets that matched the stored hash of a
+// token. The stored hash is part of the key, so a token that is deleted or
+// gets a new secret stops matching at once.
+type verifiedTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*verifiedToken
+}
+
+type verifiedToken struct {
+	hash    [sha256.Size]byte
+	expires time.Time
+}
+
+func newVerifiedTokens() *verifiedTokens {
+	return &verifiedTokens{tokens: map[string]*verifiedToken{}}
+}
+
+func tokenKey(name string, stored string) string {
+	return name + "\x00" + stored
+}
+
+func (v *verifiedTokens) valid(name string, stored string, secret string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	tok, ok := v.tokens[tokenKey(name, stored)]
+	if !ok || time.Now().After(tok.expires) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], tok.hash[:]) == 1
+}
+
+func (v *verifiedTokens) remember(name string, stored string, secret string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for k, tok := range v.tokens {
+		if now.After(tok.expires) {
+			delete(v.tokens, k)
+		}
+	}
+	v.tokens[tokenKey(name, stored)] = &verifiedToken{hash: sha256.Sum256([]byte(secret)), expires: now.Add(tokenVerifyTTL)}
+}
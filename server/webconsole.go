@@ -13,6 +13,7 @@ import (
 
 	"github.com/emersion/go-webdav"
 	gorilla "github.com/gorilla/websocket"
+	"github.com/lcpu-dev/vmsched/models"
 	"github.com/lcpu-dev/vmsched/utils"
 	lxd "github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/shared/api"
@@ -27,11 +28,13 @@ func (s *Server) HandleSpiceWs(w http.ResponseWriter, r *http.Request) {
 	if instance == "" {
 		w.WriteHeader(400)
 		w.Write([]byte("Bad Request"))
+		return
 	}
-	u := s.credentialToUser(name, secret)
-	if !s.userHaveAccessTo(u, "user", "", instance, "") {
+	tok := s.credentialToToken(name, secret, remoteIP(r))
+	if s.authorize(tok, models.ScopeConsole, ownOr(models.PermUse, models.PermConsoles), "", instance, "") == nil {
 		w.WriteHeader(403)
 		w.Write([]byte("Bad Request"))
+		return
 	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true,
@@ -94,11 +97,13 @@ func (s *Server) HandleConsoleWs(w http.ResponseWriter, r *http.Request) {
 	if instance == "" {
 		w.WriteHeader(400)
 		w.Write([]byte("Bad Request"))
+		return
 	}
-	u := s.credentialToUser(name, secret)
-	if !s.userHaveAccessTo(u, "user", "", instance, "") {
+	tok := s.credentialToToken(name, secret, remoteIP(r))
+	if s.authorize(tok, models.ScopeConsole, ownOr(models.PermUse, models.PermConsoles), "", instance, "") == nil {
 		w.WriteHeader(403)
 		w.Write([]byte("Bad Request"))
+		return
 	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true,
@@ -156,11 +161,13 @@ func (s *Server) HandleExecWs(w http.ResponseWriter, r *http.Request) {
 	if instance == "" {
 		w.WriteHeader(400)
 		w.Write([]byte("Bad Request"))
+		return
 	}
-	u := s.credentialToUser(name, secret)
-	if !s.userHaveAccessTo(u, "user", "", instance, "") {
+	tok := s.credentialToToken(name, secret, remoteIP(r))
+	if s.authorize(tok, models.ScopeConsole, ownOr(models.PermUse, models.PermConsoles), "", instance, "") == nil {
 		w.WriteHeader(403)
 		w.Write([]byte("Bad Request"))
+		return
 	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true,
@@ -434,8 +441,8 @@ func (s *Server) HandleWebDAV(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	user := s.credentialToUser(u, p)
-	if !s.userHaveAccessTo(user, "user", "", instance, "") {
+	tok := s.credentialToToken(u, p, remoteIP(r))
+	if s.authorize(tok, models.ScopeWebDAV, ownOr(models.PermUse, models.PermConsoles), "", instance, "") == nil {
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
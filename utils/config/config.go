@@ -8,10 +8,19 @@ import (
 )
 
 type Configure struct {
-	Listen       string             `yaml:"listen" json:"listen"`
-	LXD          *LXDConfigure      `yaml:"lxd" json:"lxd"`
-	Database     *DatabaseConfigure `yaml:"database" json:"database"`
-	CronInterval time.Duration      `yaml:"cron-interval" json:"cron-interval"`
+	Listen       string                `yaml:"listen" json:"listen"`
+	LXD          *LXDConfigure         `yaml:"lxd" json:"lxd"`
+	Database     *DatabaseConfigure    `yaml:"database" json:"database"`
+	CronInterval time.Duration         `yaml:"cron-interval" json:"cron-interval"`
+	LeaseTTL     time.Duration         `yaml:"lease-ttl" json:"lease-ttl"`
+	Reconcile    *ReconcileConfigure   `yaml:"reconcile" json:"reconcile"`
+	Queue        *QueueConfigure       `yaml:"queue" json:"queue"`
+	Reservation  *ReservationConfigure `yaml:"reservation" json:"reservation"`
+	Quota        *QuotaConfigure       `yaml:"quota" json:"quota"`
+	Schedule     *ScheduleConfigure    `yaml:"schedule" json:"schedule"`
+	Idle         *IdleConfigure        `yaml:"idle" json:"idle"`
+	OIDC         *OIDCConfigure        `yaml:"oidc" json:"oidc"`
+	LDAP         *LDAPConfigure        `yaml:"ldap" json:"ldap"`
 }
 
 type LXDConfigure struct {
@@ -20,6 +29,138 @@ type LXDConfigure struct {
 	ClientCert string `yaml:"client-cert" json:"client-cert"`
 }
 
+type ReconcileConfigure struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// tasks in a transitional state are only touched after this long without
+	// an update, so work in progress in another process is left alone
+	Grace time.Duration `yaml:"grace" json:"grace"`
+}
+
+type QueueConfigure struct {
+	// extending an active task is refused when it would delay the queued task
+	// of the same type the policy starts next past this long in the queue, 0
+	// means no limit
+	ExtendStarvationLimit time.Duration       `yaml:"extend-starvation-limit" json:"extend-starvation-limit"`
+	Policy                string              `yaml:"policy" json:"policy"` // name of a registered scheduler
+	Priorities            *PriorityConfigure  `yaml:"priorities" json:"priorities"`
+	FairShare             *FairShareConfigure `yaml:"fair-share" json:"fair-share"`
+}
+
+type ReservationConfigure struct {
+	// targets of a reservation that none of its users took this long after
+	// the window started are given back, 0 keeps them for the whole window
+	ReleaseAfter time.Duration `yaml:"release-after" json:"release-after"`
+}
+
+type ScheduleConfigure struct {
+	// a scheduled run found this late is a missed one, left to the missed run
+	// policy of its schedule
+	MissedAfter time.Duration `yaml:"missed-after" json:"missed-after"`
+}
+
+type IdleConfigure struct {
+	// how often the counters of active instances are read, the idle policy
+	// itself is set on every instance type
+	SampleInterval time.Duration `yaml:"sample-interval" json:"sample-interval"`
+}
+
+// OIDCConfigure enables logging in through an OpenID Connect provider, which
+// gives out session tokens. It is off while Issuer is empty.
+type OIDCConfigure struct {
+	Issuer       string   `yaml:"issuer" json:"issuer"`
+	ClientID     string   `yaml:"client-id" json:"client-id"`
+	ClientSecret string   `yaml:"client-secret" json:"client-secret"`
+	RedirectURL  string   `yaml:"redirect-url" json:"redirect-url"` // our /api/v1/oidc/callback
+	Scopes       []string `yaml:"scopes" json:"scopes"`
+	// claim holding the user name, users are created on their first login
+	// with Role and Balance
+	UsernameClaim string         `yaml:"username-claim" json:"username-claim"`
+	Role          string         `yaml:"role" json:"role"`
+	Balance       map[string]int `yaml:"balance" json:"balance"`
+	SessionTTL    time.Duration  `yaml:"session-ttl" json:"session-ttl"`
+	TokenScopes   []string       `yaml:"token-scopes" json:"token-scopes"` // of session tokens, any when empty
+	// where a login may send the session token back to, the same scheme and
+	// host and a path below; without a redirect it is shown as JSON
+	AllowedRedirects []string `yaml:"allowed-redirects" json:"allowed-redirects"`
+}
+
+// LDAPConfigure lets users authenticate with their directory name and
+// password wherever a token name and secret are accepted. It is off while URL
+// is empty.
+type LDAPConfigure struct {
+	URL          string `yaml:"url" json:"url"` // ldap:// or ldaps://
+	StartTLS     bool   `yaml:"start-tls" json:"start-tls"`
+	BindDN       string `yaml:"bind-dn" json:"bind-dn"` // searches anonymously when empty
+	BindPassword string `yaml:"bind-password" json:"bind-password"`
+	BaseDN       string `yaml:"base-dn" json:"base-dn"`
+	UserFilter   string `yaml:"user-filter" json:"user-filter"` // %s is the escaped user name
+	// groups are read from GroupAttribute of the user, or when GroupFilter is
+	// set, searched under GroupBaseDN with %s as the escaped user DN
+	GroupAttribute string `yaml:"group-attribute" json:"group-attribute"`
+	GroupBaseDN    string `yaml:"group-base-dn" json:"group-base-dn"`
+	GroupFilter    string `yaml:"group-filter" json:"group-filter"`
+	// role by group DN, banned wins over admin over user over other roles in
+	// name order; users in none of the groups get DefaultRole, or may not log
+	// in when it is empty
+	Roles        map[string]string `yaml:"roles" json:"roles"`
+	DefaultRole  string            `yaml:"default-role" json:"default-role"`
+	Balance      map[string]int    `yaml:"balance" json:"balance"`             // of users created on their first login
+	SyncInterval time.Duration     `yaml:"sync-interval" json:"sync-interval"` // how often roles are read again
+	Timeout      time.Duration     `yaml:"timeout" json:"timeout"`
+}
+
+// QuotaConfigure limits what a user may hold. A user's quota is Default with
+// the non-zero limits of its role, then of the user itself, laid over it. The
+// quota of an instance type applies on top, to the tasks of that type only.
+type QuotaConfigure struct {
+	Default *Quota            `yaml:"default" json:"default"`
+	Roles   map[string]*Quota `yaml:"roles" json:"roles"`
+	Users   map[string]*Quota `yaml:"users" json:"users"`
+	Types   map[string]*Quota `yaml:"types" json:"types"`
+}
+
+// Quota holds limits, 0 means no limit.
+type Quota struct {
+	MaxActive    int           `yaml:"max-active" json:"max-active"`       // active tasks
+	MaxQueued    int           `yaml:"max-queued" json:"max-queued"`       // tasks waiting to become active
+	MaxInstances int           `yaml:"max-instances" json:"max-instances"` // instances of all tasks
+	MaxLifeTime  time.Duration `yaml:"max-life-time" json:"max-life-time"` // lifetime of one activation
+}
+
+// Merge returns q with the non-zero limits of o laid over it.
+func (q Quota) Merge(o *Quota) Quota {
+	if o == nil {
+		return q
+	}
+	if o.MaxActive != 0 {
+		q.MaxActive = o.MaxActive
+	}
+	if o.MaxQueued != 0 {
+		q.MaxQueued = o.MaxQueued
+	}
+	if o.MaxInstances != 0 {
+		q.MaxInstances = o.MaxInstances
+	}
+	if o.MaxLifeTime != 0 {
+		q.MaxLifeTime = o.MaxLifeTime
+	}
+	return q
+}
+
+// PriorityConfigure assigns static priorities, higher goes first. A user's own
+// priority overrides the one of its role.
+type PriorityConfigure struct {
+	Users map[string]int `yaml:"users" json:"users"`
+	Roles map[string]int `yaml:"roles" json:"roles"`
+}
+
+// FairShareConfigure weights the minutes a user consumed within Window, each
+// minute counting half as much after every HalfLife.
+type FairShareConfigure struct {
+	Window   time.Duration `yaml:"window" json:"window"`
+	HalfLife time.Duration `yaml:"half-life" json:"half-life"`
+}
+
 type DatabaseConfigure struct {
 	Driver string `yaml:"driver" json:"driver"`
 	DSN    string `yaml:"dsn" json:"dsn"`
@@ -41,5 +182,89 @@ func LoadConfigure(path string) (*Configure, error) {
 	if r.Database == nil {
 		r.Database = new(DatabaseConfigure)
 	}
+	if r.Queue == nil {
+		r.Queue = new(QueueConfigure)
+	}
+	if r.Queue.Policy == "" {
+		r.Queue.Policy = "fifo"
+	}
+	if r.Quota == nil {
+		r.Quota = new(QuotaConfigure)
+	}
+	if r.Quota.Default == nil {
+		r.Quota.Default = new(Quota)
+	}
+	if r.Reservation == nil {
+		r.Reservation = new(ReservationConfigure)
+	}
+	if r.Schedule == nil {
+		r.Schedule = new(ScheduleConfigure)
+	}
+	if r.Schedule.MissedAfter <= 0 {
+		r.Schedule.MissedAfter = 5 * time.Minute
+	}
+	if r.Idle == nil {
+		r.Idle = new(IdleConfigure)
+	}
+	if r.Idle.SampleInterval <= 0 {
+		r.Idle.SampleInterval = time.Minute
+	}
+	if r.OIDC == nil {
+		r.OIDC = new(OIDCConfigure)
+	}
+	if len(r.OIDC.Scopes) == 0 {
+		r.OIDC.Scopes = []string{"openid", "profile"}
+	}
+	if r.OIDC.UsernameClaim == "" {
+		r.OIDC.UsernameClaim = "preferred_username"
+	}
+	if r.OIDC.Role == "" {
+		r.OIDC.Role = "user"
+	}
+	if r.OIDC.SessionTTL <= 0 {
+		r.OIDC.SessionTTL = 12 * time.Hour
+	}
+	if r.LDAP == nil {
+		r.LDAP = new(LDAPConfigure)
+	}
+	if r.LDAP.UserFilter == "" {
+		r.LDAP.UserFilter = "(uid=%s)"
+	}
+	if r.LDAP.GroupAttribute == "" {
+		r.LDAP.GroupAttribute = "memberOf"
+	}
+	if r.LDAP.SyncInterval <= 0 {
+		r.LDAP.SyncInterval = time.Hour
+	}
+	if r.LDAP.Timeout <= 0 {
+		r.LDAP.Timeout = 10 * time.Second
+	}
+	if r.Queue.Priorities == nil {
+		r.Queue.Priorities = new(PriorityConfigure)
+	}
+	if r.Queue.FairShare == nil {
+		r.Queue.FairShare = new(FairShareConfigure)
+	}
+	if r.Queue.FairShare.Window <= 0 {
+		r.Queue.FairShare.Window = 7 * 24 * time.Hour
+	}
+	if r.Queue.FairShare.HalfLife <= 0 {
+		r.Queue.FairShare.HalfLife = 24 * time.Hour
+	}
+	if r.Reconcile == nil {
+		r.Reconcile = new(ReconcileConfigure)
+	}
+	if r.Reconcile.Interval <= 0 {
+		r.Reconcile.Interval = 5 * time.Minute
+	}
+	if r.Reconcile.Grace <= 0 {
+		r.Reconcile.Grace = 10 * time.Minute
+	}
+	if r.CronInterval <= 0 {
+		r.CronInterval = 15 * time.Second
+	}
+	if r.LeaseTTL <= 0 {
+		r.LeaseTTL = 30 * time.Second
+	}
 	return r, nil
 }
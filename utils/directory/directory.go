@@ -0,0 +1,201 @@
+// Package directory authenticates users against an LDAP directory and maps
+// the groups they are in to vmsched roles.
+package directory
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/lcpu-dev/vmsched/utils/config"
+)
+
+var (
+	// ErrInvalidCredentials means the user is unknown or the password wrong.
+	ErrInvalidCredentials = errors.New("directory: invalid credentials")
+	// ErrNotFound means the directory has no such user.
+	ErrNotFound = errors.New("directory: user not found")
+)
+
+// rolePrecedence orders the builtin roles when a user is in groups mapped to
+// several.
+var rolePrecedence = []string{"banned", "admin", "user"}
+
+type Directory struct {
+	conf *config.LDAPConfigure
+}
+
+// Entry is what the directory knows of a user.
+type Entry struct {
+	DN     string
+	Groups []string
+}
+
+func New(conf *config.LDAPConfigure) *Directory {
+	return &Directory{conf: conf}
+}
+
+func (d *Directory) dial() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.conf.Timeout}
+	conn, err := ldap.DialURL(d.conf.URL, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(d.conf.Timeout)
+	if d.conf.StartTLS {
+		host := strings.TrimPrefix(d.conf.URL, "ldap://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if d.conf.BindDN != "" {
+		err = conn.Bind(d.conf.BindDN, d.conf.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// lookup finds the entry of a user and its groups on a connection bound as
+// the search account.
+func (d *Directory) lookup(conn *ldap.Conn, user string) (*Entry, error) {
+	attrs := []string{"dn"}
+	if d.conf.GroupFilter == "" {
+		attrs = append(attrs, d.conf.GroupAttribute)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		d.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(d.conf.UserFilter, ldap.EscapeFilter(user)), attrs, nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrNotFound
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("directory: %v matches several entries", user)
+	}
+	e := &Entry{DN: res.Entries[0].DN}
+	if d.conf.GroupFilter == "" {
+		e.Groups = res.Entries[0].GetAttributeValues(d.conf.GroupAttribute)
+		return e, nil
+	}
+	groups, err := conn.Search(ldap.NewSearchRequest(
+		d.conf.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(d.conf.GroupFilter, ldap.EscapeFilter(e.DN)), []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups.Entries {
+		e.Groups = append(e.Groups, g.DN)
+	}
+	return e, nil
+}
+
+// Authenticate checks the password of a user by binding as it.
+func (d *Directory) Authenticate(user string, password string) (*Entry, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	e, err := d.lookup(conn, user)
+	if err == ErrNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Bind(e.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LookupAll returns the entries of users over one connection, users the
+// directory doesn't have are left out. Any other error fails the whole lookup
+// so that an unreachable directory is never taken for an empty one.
+func (d *Directory) LookupAll(users []string) (map[string]*Entry, error) {
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entries := map[string]*Entry{}
+	for _, user := range users {
+		e, err := d.lookup(conn, user)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[user] = e
+	}
+	return entries, nil
+}
+
+// Role maps the groups of an entry to a role, empty when none applies.
+func (d *Directory) Role(e *Entry) string {
+	roles := map[string]bool{}
+	for _, g := range e.Groups {
+		for dn, role := range d.conf.Roles {
+			if strings.EqualFold(normalizeDN(dn), normalizeDN(g)) {
+				roles[role] = true
+			}
+		}
+	}
+	for _, role := range rolePrecedence {
+		if roles[role] {
+			return role
+		}
+	}
+	// roles of their own come after, in name order
+	others := []string{}
+	for role := range roles {
+		others = append(others, role)
+	}
+	if len(others) > 0 {
+		sort.Strings(others)
+		return others[0]
+	}
+	return d.conf.DefaultRole
+}
+
+// normalizeDN drops the spaces around the separators of a DN, which
+// directories return as they like.
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		kv := strings.SplitN(p, "=", 2)
+		for j := range kv {
+			kv[j] = strings.TrimSpace(kv[j])
+		}
+		parts[i] = strings.Join(kv, "=")
+	}
+	return strings.Join(parts, ",")
+}
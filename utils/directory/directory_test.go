@@ -0,0 +1,283 @@
+package directory
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/lcpu-dev/vmsched/utils/config"
+)
+
+const (
+	serviceDN       = "cn=vmsched,ou=services,dc=x"
+	servicePassword = "service"
+)
+
+type person struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// fakeDirectory is an LDAP server knowing a few people, enough of the
+// protocol for the client: simple binds, equality searches and unbinds.
+// Searches for uid look people up, those for member look up the groups
+// listing a DN.
+type fakeDirectory struct {
+	mu     sync.Mutex
+	people map[string]*person // by uid
+	broken map[string]bool    // uids whose search fails
+	binds  int                // successful binds as a person
+}
+
+func (d *fakeDirectory) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.handle(c)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func (d *fakeDirectory) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case 0: // bind
+			c.Write(result(id, 1, d.bind(string(op.Children[1].Data.Bytes()), string(op.Children[2].Data.Bytes()))).Bytes())
+		case 3: // search
+			attr := strings.ToLower(string(op.Children[6].Children[0].Data.Bytes()))
+			value := string(op.Children[6].Children[1].Data.Bytes())
+			entries, code := d.search(attr, value)
+			for _, e := range entries {
+				c.Write(e(id).Bytes())
+			}
+			c.Write(result(id, 5, code).Bytes())
+		case 2: // unbind
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(dn string, password string) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dn == serviceDN && password == servicePassword {
+		return 0
+	}
+	for _, p := range d.people {
+		if p.dn == dn && p.password == password {
+			d.binds++
+			return 0
+		}
+	}
+	return 49 // invalid credentials
+}
+
+func (d *fakeDirectory) search(attr string, value string) ([]func(int64) *ber.Packet, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := []func(int64) *ber.Packet{}
+	switch attr {
+	case "uid":
+		if d.broken[value] {
+			return nil, 1 // operations error
+		}
+		if p, ok := d.people[value]; ok {
+			entries = append(entries, entry(p.dn, "memberOf", p.groups))
+		}
+	case "member":
+		groups := map[string]bool{}
+		for _, p := range d.people {
+			if p.dn != value {
+				continue
+			}
+			for _, g := range p.groups {
+				if !groups[g] {
+					groups[g] = true
+					entries = append(entries, entry(g, "", nil))
+				}
+			}
+		}
+	}
+	return entries, 0
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	m := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	m.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	m.AppendChild(op)
+	return m
+}
+
+func octets(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func result(id int64, tag ber.Tag, code int64) *ber.Packet {
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	r.AppendChild(octets(""))
+	r.AppendChild(octets(""))
+	return message(id, r)
+}
+
+func entry(dn string, attr string, values []string) func(int64) *ber.Packet {
+	return func(id int64) *ber.Packet {
+		e := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+		e.AppendChild(octets(dn))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		if attr != "" {
+			a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			a.AppendChild(octets(attr))
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				vals.AppendChild(octets(v))
+			}
+			a.AppendChild(vals)
+			attrs.AppendChild(a)
+		}
+		e.AppendChild(attrs)
+		return message(id, e)
+	}
+}
+
+func newFake(t *testing.T) (*fakeDirectory, *config.LDAPConfigure) {
+	d := &fakeDirectory{
+		people: map[string]*person{
+			"alice": {"uid=alice,ou=people,dc=x", "pw-alice", []string{"cn=admins, ou=groups,dc=x"}},
+			"bob":   {"uid=bob,ou=people,dc=x", "pw-bob", []string{"cn=staff,ou=groups,dc=x"}},
+			"carol": {"uid=carol,ou=people,dc=x", "pw-carol", nil},
+		},
+		broken: map[string]bool{},
+	}
+	conf := &config.LDAPConfigure{
+		URL:            d.serve(t),
+		BindDN:         serviceDN,
+		BindPassword:   servicePassword,
+		BaseDN:         "ou=people,dc=x",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		Timeout:        5 * time.Second,
+	}
+	return d, conf
+}
+
+func TestAuthenticate(t *testing.T) {
+	fake, conf := newFake(t)
+	for _, groupSearch := range []bool{false, true} {
+		if groupSearch {
+			conf.GroupBaseDN = "ou=groups,dc=x"
+			conf.GroupFilter = "(member=%s)"
+		}
+		dir := New(conf)
+		e, err := dir.Authenticate("alice", "pw-alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.DN != "uid=alice,ou=people,dc=x" || len(e.Groups) != 1 || e.Groups[0] != "cn=admins, ou=groups,dc=x" {
+			t.Errorf("group search %v: got %+v", groupSearch, e)
+		}
+	}
+	dir := New(conf)
+	for _, c := range []struct{ user, password string }{
+		{"alice", "pw-bob"},
+		{"nobody", "pw-alice"},
+		{"alice*", "pw-alice"},
+	} {
+		if _, err := dir.Authenticate(c.user, c.password); err != ErrInvalidCredentials {
+			t.Errorf("%v with %v: %v", c.user, c.password, err)
+		}
+	}
+	binds := fake.binds
+	// an unauthenticated bind would succeed, it must not get that far
+	if _, err := dir.Authenticate("alice", ""); err != ErrInvalidCredentials {
+		t.Errorf("empty password: %v", err)
+	}
+	if fake.binds != binds {
+		t.Error("empty password bound")
+	}
+	fake.broken["bob"] = true
+	if _, err := dir.Authenticate("bob", "pw-bob"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("failed search: %v", err)
+	}
+}
+
+func TestRole(t *testing.T) {
+	dir := New(&config.LDAPConfigure{
+		Roles: map[string]string{
+			"cn=banned,ou=groups,dc=x": "banned",
+			"cn=admins,ou=groups,dc=x": "admin",
+			"cn=staff,ou=groups,dc=x":  "user",
+			"cn=ta,ou=groups,dc=x":     "teaching",
+			"cn=lab,ou=groups,dc=x":    "lab",
+		},
+		DefaultRole: "guest",
+	})
+	cases := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"cn=staff,ou=groups,dc=x", "cn=admins,ou=groups,dc=x"}, "admin"},
+		{[]string{"cn=admins,ou=groups,dc=x", "cn=banned,ou=groups,dc=x"}, "banned"},
+		{[]string{"cn=ta,ou=groups,dc=x", "cn=staff,ou=groups,dc=x"}, "user"},
+		{[]string{"cn=ta,ou=groups,dc=x", "cn=lab,ou=groups,dc=x"}, "lab"},
+		{[]string{"CN=Admins , OU=groups,DC=x"}, "admin"},
+		{[]string{"cn=other,ou=groups,dc=x"}, "guest"},
+		{nil, "guest"},
+	}
+	for _, c := range cases {
+		if got := dir.Role(&Entry{Groups: c.groups}); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.groups, got, c.want)
+		}
+	}
+	dir.conf.DefaultRole = ""
+	if got := dir.Role(&Entry{}); got != "" {
+		t.Errorf("no groups without a default role: got %v", got)
+	}
+}
+
+func TestLookupAll(t *testing.T) {
+	fake, conf := newFake(t)
+	dir := New(conf)
+	entries, err := dir.LookupAll([]string{"alice", "bob", "gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// users the directory doesn't have are left out, to be banned
+	if len(entries) != 2 || entries["alice"] == nil || entries["bob"] == nil {
+		t.Errorf("got %v", entries)
+	}
+	// any other failure fails the lookup, nobody is taken for gone
+	fake.broken["bob"] = true
+	if entries, err := dir.LookupAll([]string{"alice", "bob"}); err == nil {
+		t.Errorf("failed search: got %v", entries)
+	}
+	conf.BindPassword = "wrong"
+	if entries, err := New(conf).LookupAll([]string{"alice"}); err == nil {
+		t.Errorf("service account rejected: got %v", entries)
+	}
+	down := *conf
+	down.URL = "ldap://127.0.0.1:1"
+	if entries, err := New(&down).LookupAll([]string{"alice"}); err == nil {
+		t.Errorf("directory down: got %v", entries)
+	}
+}
@@ -0,0 +1,250 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idp is a provider serving discovery, its key set and a token endpoint that
+// hands out whatever ID token is set for a code.
+type idp struct {
+	*httptest.Server
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	tokens map[string]string // ID token by code
+}
+
+func newIDP(t *testing.T) *idp {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &idp{rsa: rk, ec: ek, tokens: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize?tenant=x",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ek.X.FillBytes(make([]byte, 32))), "y": b64(ek.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "vmsched" || secret != "secret" || r.PostFormValue("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		raw, ok := p.tokens[r.PostFormValue("code")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": raw, "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *idp) provider() *Provider {
+	return &Provider{
+		Issuer:       p.URL,
+		ClientID:     "vmsched",
+		ClientSecret: "secret",
+		RedirectURL:  "https://vmsched.example.edu/api/v1/oidc/callback",
+		Scopes:       []string{"openid", "profile"},
+	}
+}
+
+// claims returns valid claims for nonce, to be spoiled by the tests.
+func (p *idp) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   "1234",
+		"aud":   "vmsched",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+	}
+}
+
+// sign makes an ID token naming kid, ES256 with the EC key for ec and RS256
+// with the RSA key for anything else.
+func (p *idp) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if kid == "ec" {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	if alg == "RS256" {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, p.rsa, crypto.SHA256, digest[:])
+	} else {
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, p.ec, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// header makes the header segment of an ID token.
+func (p *idp) header(t *testing.T, alg string, kid string) string {
+	b, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newIDP(t)
+	u, err := p.provider().AuthCodeURL(context.Background(), "st", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parsed.Query()
+	if parsed.Path != "/authorize" || q.Get("tenant") != "x" {
+		t.Errorf("endpoint query lost in %v", u)
+	}
+	if q.Get("state") != "st" || q.Get("nonce") != "n" || q.Get("client_id") != "vmsched" ||
+		q.Get("scope") != "openid profile" || q.Get("response_type") != "code" {
+		t.Errorf("bad parameters in %v", u)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	p := newIDP(t)
+	prov := p.provider()
+	prov.Issuer = p.URL + "/"
+	if _, err := prov.AuthCodeURL(context.Background(), "st", "n"); err == nil {
+		t.Error("provider claiming another issuer accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newIDP(t)
+	p.tokens["code"] = "raw"
+	prov := p.provider()
+	raw, err := prov.Exchange(context.Background(), "code")
+	if err != nil || raw != "raw" {
+		t.Errorf("got %#v, %v", raw, err)
+	}
+	if _, err := prov.Exchange(context.Background(), "other"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("unknown code: %v", err)
+	}
+	prov.ClientSecret = "wrong"
+	if _, err := prov.Exchange(context.Background(), "code"); err == nil {
+		t.Error("wrong client secret accepted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p := newIDP(t)
+	cases := []struct {
+		name  string
+		kid   string
+		spoil func(c map[string]interface{})
+		ok    bool
+	}{
+		{"RS256", "rsa", nil, true},
+		{"ES256", "ec", nil, true},
+		{"audience among others", "rsa", func(c map[string]interface{}) { c["aud"] = []string{"other", "vmsched"} }, true},
+		{"other issuer", "rsa", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, false},
+		{"other audience", "ec", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"no audience", "rsa", func(c map[string]interface{}) { delete(c, "aud") }, false},
+		{"expired", "rsa", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * leeway).Unix() }, false},
+		{"expired within leeway", "rsa", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-leeway / 2).Unix() }, true},
+		{"no expiry", "ec", func(c map[string]interface{}) { delete(c, "exp") }, false},
+		{"issued in the future", "rsa", func(c map[string]interface{}) { c["iat"] = time.Now().Add(2 * leeway).Unix() }, false},
+		{"other nonce", "rsa", func(c map[string]interface{}) { c["nonce"] = "replayed" }, false},
+		{"no nonce", "ec", func(c map[string]interface{}) { delete(c, "nonce") }, false},
+		{"key not for signing", "enc", nil, false},
+		{"unknown key", "nope", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := p.claims("n")
+			if c.spoil != nil {
+				c.spoil(claims)
+			}
+			raw := p.sign(t, c.kid, claims)
+			got, err := p.provider().Verify(context.Background(), raw, "n")
+			if c.ok && (err != nil || got["sub"] != "1234") {
+				t.Errorf("rejected: %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	p := newIDP(t)
+	prov := p.provider()
+	raw := p.sign(t, "rsa", p.claims("n"))
+	parts := strings.Split(raw, ".")
+	// the claims changed after signing
+	spoiled := p.claims("n")
+	spoiled["sub"] = "admin"
+	payload, _ := json.Marshal(spoiled)
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	if _, err := prov.Verify(context.Background(), forged, "n"); err == nil {
+		t.Error("forged claims accepted")
+	}
+	// an RSA key named for ES256
+	ec := p.header(t, "ES256", "rsa") + "." + parts[1] + "." + parts[2]
+	if _, err := prov.Verify(context.Background(), ec, "n"); err == nil {
+		t.Error("algorithm confusion accepted")
+	}
+	none := p.header(t, "none", "rsa") + "." + parts[1] + "."
+	if _, err := prov.Verify(context.Background(), none, "n"); err == nil {
+		t.Error("unsigned token accepted")
+	}
+	if _, err := prov.Verify(context.Background(), "a.b", "n"); err == nil {
+		t.Error("malformed token accepted")
+	}
+}